@@ -0,0 +1,215 @@
+//go:build ffmpeg
+// +build ffmpeg
+
+package x264
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"os/exec"
+	"testing"
+)
+
+// decodeI420 decodes Annex B stream with ffmpeg and returns the decoded I420 frames cropped to the given size.
+// Odd sizes are padded by the encoder, ffmpeg decodes the size signaled by the SPS.
+func decodeI420(t *testing.T, stream []byte, w, h int) (frames [][]byte) {
+	t.Helper()
+
+	dw, dh := decodedSize(stream)
+	if dw < w || dh < h {
+		t.Fatalf("stream size %dx%d, want at least %dx%d", dw, dh, w, h)
+	}
+
+	cmd := exec.Command("ffmpeg", "-v", "error", "-f", "h264", "-i", "-", "-f", "rawvideo", "-pix_fmt", "yuv420p", "-")
+	cmd.Stdin = bytes.NewReader(stream)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("ffmpeg: %v: %s", err, stderr.Bytes())
+	}
+
+	dcw, dch := (dw+1)/2, (dh+1)/2
+	size := dw*dh + 2*dcw*dch
+	if len(out)%size != 0 {
+		t.Fatalf("decoded %d bytes, not a multiple of frame size %d", len(out), size)
+	}
+
+	cw, ch := (w+1)/2, (h+1)/2
+
+	for ; len(out) > 0; out = out[size:] {
+		frame := make([]byte, 0, w*h+2*cw*ch)
+		for y := 0; y < h; y++ {
+			frame = append(frame, out[y*dw:y*dw+w]...)
+		}
+
+		for _, plane := range [][]byte{out[dw*dh : dw*dh+dcw*dch], out[dw*dh+dcw*dch : size]} {
+			for y := 0; y < ch; y++ {
+				frame = append(frame, plane[y*dcw:y*dcw+cw]...)
+			}
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return
+}
+
+// decodedSize returns the picture size signaled by the first SPS of Annex B stream.
+func decodedSize(stream []byte) (w, h int) {
+	for _, part := range bytes.Split(stream, []byte{0, 0, 1}) {
+		if len(part) > 0 && int32(part[0]&0x1f) == NALSPS {
+			return spsDisplaySize(part)
+		}
+	}
+
+	return
+}
+
+// gradient returns RGBA image with a diagonal gradient moving with frame number i.
+func gradient(w, h, i int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := img.PixOffset(x, y)
+			img.Pix[o] = uint8((x + 2*i) * 255 / (w + 40))
+			img.Pix[o+1] = uint8(y * 255 / h)
+			img.Pix[o+2] = uint8((x + y + 4*i) * 255 / (w + h + 80))
+			img.Pix[o+3] = 255
+		}
+	}
+
+	return img
+}
+
+// referenceI420 converts im to I420 with BT.601 studio range, chroma is averaged over 2x2 blocks.
+func referenceI420(im *image.RGBA) []byte {
+	w, h := im.Rect.Dx(), im.Rect.Dy()
+	cw, ch := (w+1)/2, (h+1)/2
+
+	ref := make([]byte, w*h+2*cw*ch)
+	cb, cr := ref[w*h:w*h+cw*ch], ref[w*h+cw*ch:]
+
+	sumCb := make([]int, cw*ch)
+	sumCr := make([]int, cw*ch)
+	count := make([]int, cw*ch)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			o := im.PixOffset(x, y)
+			yy, u, v := RGBToYCbCrBT601(im.Pix[o], im.Pix[o+1], im.Pix[o+2])
+
+			ref[y*w+x] = yy
+
+			c := (y/2)*cw + x/2
+			sumCb[c] += int(u)
+			sumCr[c] += int(v)
+			count[c]++
+		}
+	}
+
+	for i := range count {
+		cb[i] = uint8((sumCb[i] + count[i]/2) / count[i])
+		cr[i] = uint8((sumCr[i] + count[i]/2) / count[i])
+	}
+
+	return ref
+}
+
+// psnr returns the PSNR in dB of b against a.
+func psnr(a, b []byte) float64 {
+	var sse float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sse += d * d
+	}
+
+	if sse == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(255*255*float64(len(a))/sse)
+}
+
+// TestDecodeRoundTrip checks the stream decodes to the input, run with go test -tags ffmpeg.
+func TestDecodeRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+
+	for _, tc := range []struct {
+		input      string
+		w, h       int
+		colorSpace int32
+	}{
+		{"rgba", 320, 240, ColorSpaceI420},
+		{"ycbcr", 320, 240, ColorSpaceI420},
+		{"nrgba", 321, 241, ColorSpaceI420},
+		{"rgba", 320, 240, ColorSpaceNV12},
+	} {
+		name := fmt.Sprintf("%s %dx%d colorspace %d", tc.input, tc.w, tc.h, tc.colorSpace)
+
+		opts := &Options{
+			Width:      tc.w,
+			Height:     tc.h,
+			FrameRate:  25,
+			Preset:     "veryfast",
+			Profile:    "high",
+			ColorSpace: tc.colorSpace,
+			LogLevel:   LogError,
+		}
+
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var refs [][]byte
+
+		for i := 0; i < 10; i++ {
+			img := gradient(tc.w, tc.h, i)
+			refs = append(refs, referenceI420(img))
+
+			var im image.Image = img
+			switch tc.input {
+			case "ycbcr":
+				p := NewYCbCr(img.Rect)
+				p.ToYCbCr(img)
+				im = p
+			case "nrgba":
+				im = &image.NRGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect}
+			}
+
+			err = enc.Encode(im)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames := decodeI420(t, buf.Bytes(), tc.w, tc.h)
+		if len(frames) != len(refs) {
+			t.Fatalf("%s: decoded %d frames, want %d", name, len(frames), len(refs))
+		}
+
+		luma := tc.w * tc.h
+		for i := range frames {
+			if p := psnr(refs[i][:luma], frames[i][:luma]); p < 35 {
+				t.Errorf("%s: frame %d luma PSNR %.2f dB", name, i, p)
+			}
+
+			if p := psnr(refs[i][luma:], frames[i][luma:]); p < 30 {
+				t.Errorf("%s: frame %d chroma PSNR %.2f dB", name, i, p)
+			}
+		}
+	}
+}
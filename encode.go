@@ -3,13 +3,21 @@ package x264
 
 /*
 #include <stdlib.h>
+#include <string.h>
 */
 import "C"
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
 
 	"github.com/samespace/x264-go/x264c"
 )
@@ -23,12 +31,193 @@ const (
 	LogDebug
 )
 
+// Rate control constants.
+const (
+	RateControlDefault int32 = iota
+	RateControlCQP
+	RateControlCRF
+	RateControlABR
+)
+
+// SEI payload type of user data unregistered messages.
+const seiUserDataUnregistered = 5
+
+// Adaptive B-frame placement constants.
+const (
+	BFrameAdaptiveDefault int32 = iota
+	BFrameAdaptiveNone
+	BFrameAdaptiveFast
+	BFrameAdaptiveTrellis
+)
+
+// Adaptive quantization mode constants.
+const (
+	AQModeDefault int32 = iota
+	AQModeNone
+	AQModeVariance
+	AQModeAutoVariance
+	AQModeAutoVarianceBiased
+)
+
+// Entropy coding constants.
+const (
+	EntropyDefault int32 = iota
+	EntropyCABAC
+	EntropyCAVLC
+)
+
+// Quantization matrix preset constants.
+const (
+	CQMDefault int32 = iota
+	CQMFlat
+	CQMJVT
+)
+
+// Color range constants.
+const (
+	ColorRangeDefault int32 = iota
+	ColorRangeLimited
+	ColorRangeFull
+)
+
+// Color space constants.
+const (
+	ColorSpaceI420 int32 = iota
+	ColorSpaceNV12
+	ColorSpaceI444
+	ColorSpaceI400
+	ColorSpaceI422
+)
+
+// NAL format constants.
+const (
+	// NAL units prefixed with start codes.
+	NALFormatAnnexB int32 = iota
+	// NAL units prefixed with 4-byte big-endian length, as used in MP4.
+	NALFormatAVCC
+)
+
+// NAL unit type constants.
+const (
+	NALUnknown int32 = iota
+	NALSlice
+	NALSliceDPA
+	NALSliceDPB
+	NALSliceDPC
+	NALSliceIDR
+	NALSEI
+	NALSPS
+	NALPPS
+	NALAUD
+	NALFiller
+)
+
+// NAL represents NAL unit.
+type NAL struct {
+	// NAL unit type, NALSlice, NALSliceIDR, NALSEI, NALSPS, NALPPS etc.
+	Type int32
+	// NAL priority (nal_ref_idc), 0 for disposable to 3 for highest.
+	Priority int32
+	// Payload without start code or length prefix.
+	Payload []byte
+}
+
+// FrameType represents picture type.
+type FrameType int32
+
+// Frame type constants.
+const (
+	FrameAuto FrameType = x264c.TypeAuto
+	FrameIDR  FrameType = x264c.TypeIdr
+	FrameI    FrameType = x264c.TypeI
+	FrameP    FrameType = x264c.TypeP
+	FrameBref FrameType = x264c.TypeBref
+	FrameB    FrameType = x264c.TypeB
+)
+
+// FrameInfo represents encoded frame metadata.
+type FrameInfo struct {
+	// Frame type.
+	Type FrameType
+	// Presentation timestamp.
+	PTS int64
+	// Decoding timestamp, increasing in output order and never after PTS.
+	// With B-frames the initial frames have negative DTS, muxers that require non-negative values
+	// should shift all timestamps by the first DTS.
+	DTS int64
+	// Frame quantizer.
+	QP int
+	// Whether frame is a keyframe.
+	Keyframe bool
+	// Whether x264 buffered the picture and output no frame, the other fields are zero.
+	Buffered bool
+}
+
+// encodeResult classifies the return value of x264 encode and headers calls.
+type encodeResult int
+
+const (
+	// x264 failed.
+	resultError encodeResult = iota
+	// Nothing was output, the picture was buffered.
+	resultBuffered
+	// Payload of the returned size was output.
+	resultOutput
+)
+
+// resultOf returns the result of x264 return value ret, the payload size or a negative error.
+func resultOf(ret int32) encodeResult {
+	switch {
+	case ret < 0:
+		return resultError
+	case ret == 0:
+		return resultBuffered
+	}
+
+	return resultOutput
+}
+
+// PlaneInput represents a converted picture for EncodePlanes, i.e. prepared on a worker pool ahead of encoding.
+// Planes are laid out as for EncodeRaw, for ColorSpaceNV12 Cb holds the interleaved CbCr plane and Cr is unused,
+// for ColorSpaceI400 only Y is used. Strides are in bytes.
+type PlaneInput struct {
+	Y, Cb, Cr []byte
+	StrideY   int
+	StrideC   int
+	// Presentation timestamp in Timebase units, as with EncodeWithPTS.
+	PTS int64
+}
+
+// QuantMatrices represents custom quantization matrices in raster order, as listed in JM format CQM files.
+// Values are 1-255, 16 is flat.
+type QuantMatrices struct {
+	Intra4x4Luma   [16]uint8
+	Inter4x4Luma   [16]uint8
+	Intra4x4Chroma [16]uint8
+	Inter4x4Chroma [16]uint8
+	Intra8x8Luma   [64]uint8
+	Inter8x8Luma   [64]uint8
+	// 8x8 chroma matrices are used with ColorSpaceI444 only.
+	Intra8x8Chroma [64]uint8
+	Inter8x8Chroma [64]uint8
+}
+
 // Options represent encoding options.
 type Options struct {
-	// Frame width.
+	// Frame width. Odd dimensions are padded to even for 4:2:0 color spaces, odd widths also for 4:2:2,
+	// the stream is one pixel larger.
 	Width int
 	// Frame height.
 	Height int
+	// Pixels cropped from the edges of the displayed picture, signaled in the SPS. Multiples of 2 for 4:2:0 color spaces,
+	// horizontally also for 4:2:2.
+	// Sizes that are not multiples of 16 are cropped by x264 without these.
+	CropLeft   int
+	CropTop    int
+	CropRight  int
+	CropBottom int
+	// Scale images of other sizes to Width x Height with bilinear filtering, otherwise they are rejected.
+	Resize bool
 	// Frame rate.
 	FrameRate int
 	// Tunings: film, animation, grain, stillimage, psnr, ssim, fastdecode, zerolatency.
@@ -37,11 +226,167 @@ type Options struct {
 	Preset string
 	// Profiles: baseline, main, high, high10, high422, high444.
 	Profile string
+	// H.264 level, i.e. "3.1", "4.0", "5.1". Empty lets x264 select it, see Encoder.Level.
+	Level string
 	// Log level.
 	LogLevel int32
+	// Rate control method: RateControlCQP, RateControlCRF, RateControlABR. RateControlDefault keeps the preset setting.
+	RateControl int32
+	// Quantizer, used with RateControlCQP. Range is 0-51, 0 is lossless.
+	QP int
+	// Quantizer of I frames, used with RateControlCQP. Zero derives it from QP with the x264 default offset.
+	QPI int
+	// Quantizer of B frames, used with RateControlCQP. Zero derives it from QP with the x264 default offset.
+	QPB int
+	// Constant rate factor, used with RateControlCRF. Zero keeps the preset value.
+	CRF float32
+	// Target bitrate in kbps, used with RateControlABR.
+	Bitrate int
+	// VBV maximum bitrate in kbps. Zero keeps the preset value.
+	VBVMaxRate int
+	// VBV buffer size in kbits. Zero keeps the preset value.
+	VBVBufferSize int
+	// Two-pass encoding pass, 1 writes StatsFile and 2 reads it, zero is single pass. Pass 2 requires RateControlABR.
+	// Encode the input with a Pass 1 encoder and close it, which finalizes the stats file, then encode the same input
+	// with a Pass 2 encoder using the same options, the first pass output can be discarded.
+	Pass int
+	// Two-pass stats file, x264 also uses the file name with a .mbtree suffix. Empty means x264_2pass.log.
+	StatsFile string
+	// Input color space: ColorSpaceI420, ColorSpaceNV12, ColorSpaceI422 (requires high422 or high444 profile),
+	// ColorSpaceI444 (requires high444 profile), ColorSpaceI400 (monochrome, requires high profile).
+	// Images are converted to the chroma subsampling of the color space.
+	ColorSpace int32
+	// Output NAL format: NALFormatAnnexB, NALFormatAVCC.
+	NALFormat int32
+	// Do not write stream headers when the encoder is opened or reset, call WriteHeaders to place them.
+	// SPS and PPS are still repeated with every keyframe unless NoRepeatHeaders is set.
+	DeferHeaders bool
+	// Write SPS and PPS only once at the start of the stream instead of before every keyframe,
+	// for muxers that store them out of band. Streams joined mid-way cannot be decoded without them.
+	NoRepeatHeaders bool
+	// Begin every access unit with an access unit delimiter NAL, as MPEG-TS and some broadcast decoders require.
+	AUD bool
+	// Bit depth, 8 or 10. Zero means 8. 10-bit requires high10 or higher profile and x264 built with 10-bit support.
+	BitDepth int
+	// Variable frame rate input, rate control uses frame timestamps passed with EncodeWithPTS instead of FrameRate.
+	VFR bool
+	// Timebase denominator of VFR timestamps, i.e. 1000 for milliseconds. Zero means FrameRate.
+	Timebase int
+	// Convert variable rate input to constant FrameRate: EncodeWithPTS takes timestamps in Timebase units, drops frames
+	// behind the FrameRate cadence and repeats the previous image to fill gaps. Output PTS are frame numbers.
+	// It cannot be used with VFR.
+	CFR bool
+	// Encode interlaced content with adaptive field/frame macroblock pairs (MBAFF), each image holds both fields.
+	// Baseline profile and H.264 levels below 2.1 or above 4.1 do not allow it. Height must be a multiple of 4
+	// for 4:2:0 color spaces, 2 otherwise, and vertical crops twice the usual multiple.
+	Interlaced bool
+	// Field order of Interlaced content, top field first unless set.
+	BottomFieldFirst bool
+	// Use periodic intra refresh instead of IDR frames, lowers bitrate peaks for streaming but hurts seekability.
+	IntraRefresh bool
+	// Maximum keyframe interval in frames, the intra refresh period when intra refresh is used. Zero means FrameRate.
+	KeyintMax int
+	// Use open GOPs, keyframes after the first are I-frames with recovery point SEI instead of IDR frames.
+	// Compresses better with B-frames, but B-frames after a keyframe may reference the previous GOP,
+	// so seeking or joining a stream is exact only at IDR frames and some players handle it poorly.
+	OpenGOP bool
+	// Minimum keyframe interval in frames, scenecuts closer than this are coded as I frames. Zero means x264 auto.
+	KeyintMin int
+	// Scenecut threshold, how aggressively to insert extra I frames. Zero keeps the preset value, negative disables.
+	SceneCut int
+	// Number of encoding threads, zero means x264 auto. Frame-based threading delays output by one frame per thread.
+	Threads int
+	// Use slice-based threading, no added delay but lower compression efficiency. False keeps the tune value,
+	// zerolatency already enables it.
+	SlicedThreads bool
+	// Produce byte-identical output across runs and machines, encodes on a single thread with CPU independent algorithms.
+	// It is slower and cannot be combined with Threads other than 1.
+	Deterministic bool
+	// Maximum slice size in bytes, including NAL overhead. Frames are split into more slices to stay below it,
+	// i.e. the RTP payload size to avoid IP fragmentation. Zero means unlimited.
+	SliceMaxSize int
+	// Number of slices per frame, each covering whole macroblock rows, up to the number of rows. Zero means one slice.
+	// It is ignored with SliceMaxSize, and with sliced threads, which use one slice per thread, zerolatency enables them.
+	Slices int
+	// Maximum number of consecutive B-frames, up to 16. Zero keeps the preset value, negative disables.
+	// B-frames add delay and are rejected with zerolatency tuning.
+	BFrames int
+	// Adaptive B-frame placement: BFrameAdaptiveNone, BFrameAdaptiveFast, BFrameAdaptiveTrellis. BFrameAdaptiveDefault keeps the preset setting.
+	BFrameAdaptive int32
+	// Number of reference frames, up to 16. Zero keeps the preset value. x264 uses a single reference with intra refresh.
+	RefFrames int
+	// Decoded picture buffer size in frames, up to 16. Frames beyond RefFrames are not searched but kept as fallback
+	// references for InvalidateReference. Zero keeps the x264 default, RefFrames.
+	DPBSize int
+	// Entropy coding: EntropyCABAC (not with baseline profile), EntropyCAVLC, faster to decode but about 10% larger.
+	// EntropyDefault keeps the preset setting, baseline profile always uses CAVLC.
+	Entropy int32
+	// Adaptive quantization: AQModeNone disables it, AQModeVariance, AQModeAutoVariance, AQModeAutoVarianceBiased.
+	// AQModeDefault keeps the preset setting.
+	AQMode int32
+	// Quantization matrices: CQMFlat, CQMJVT (requires high profile or higher). CQMDefault keeps the x264 default, flat.
+	CQMPreset int32
+	// Custom quantization matrices, overriding CQMPreset. Requires high profile or higher.
+	CQM *QuantMatrices
+	// Adaptive quantization strength, higher values move bits from detailed to flat and dark areas. Zero keeps the preset value.
+	AQStrength float32
+	// Advanced: psychovisual rate-distortion strength, 0-10. Zero keeps the preset value, negative disables.
+	// Psy optimizations are off with psnr and ssim tunings.
+	PsyRD float32
+	// Advanced: psychovisual trellis strength, 0-10. Zero keeps the preset value, negative disables.
+	PsyTrellis float32
+	// Disable all psy optimizations regardless of preset and tune, for PSNR and SSIM comparisons.
+	// Unlike the psnr and ssim tunings it leaves AQ unchanged. It cannot be combined with PsyRD or PsyTrellis.
+	DisablePsy bool
+	// Advanced: deblocking filter strength and threshold offsets, -6 to 6, higher is stronger.
+	// Both zero keep the tune values.
+	DeblockAlpha int
+	DeblockBeta  int
+	// Rate control lookahead in frames, up to 250. Zero keeps the preset value, negative disables.
+	// Output is delayed by the lookahead, zerolatency already disables it.
+	RCLookahead int
+	// Disable macroblock-tree rate control, which lowers the quantizer of blocks that later frames reference.
+	// Without it the lookahead only serves frame type decisions and VBV, it can help irregular high-motion content.
+	NoMBTree bool
+	// Signaled color range: ColorRangeLimited, ColorRangeFull. ColorRangeDefault leaves the range unsignaled, limited.
+	ColorRange int32
+	// Signaled color primaries, x264 names, i.e. bt709, bt470bg, smpte170m, bt2020. Empty leaves them undefined.
+	ColorPrimaries string
+	// Signaled transfer characteristics, x264 names, i.e. bt709, smpte170m, smpte2084, arib-std-b67. Empty leaves them undefined.
+	TransferCharacteristics string
+	// Signaled color matrix, x264 names, i.e. bt709, bt470bg, smpte170m, bt2020nc. Empty leaves it undefined.
+	// With bt709 images are converted using BT.709 coefficients, otherwise BT.601.
+	ColorMatrix string
+	// Receives x264 log lines at or below LogLevel instead of stderr, level is one of LogError, LogWarning, LogInfo, LogDebug.
+	// It may be called from x264 threads and cannot be changed with Reconfig.
+	Logger func(level int, msg string)
+	// Advanced: x264 parameters by x264 CLI name without dashes, i.e. "me": "umh" or "no-fast-pskip": "1".
+	// They are applied in name order after the other fields and before Profile, overriding the fields.
+	Extra map[string]string
+	// Called with each encoded frame written to the writer, before writing it. Frames returned by EncodeFrame,
+	// EncodeFrameInfo and EncodeNALs are not passed. Use a nil writer to only receive the callback.
+	// b must not be modified, it stays valid after the call. It can be changed with Reconfig.
+	OnFrame func(info FrameInfo, b []byte)
+	// Called with the PTS of each keyframe written to the writer, before OnFrame and writing it, i.e. to start
+	// a new segment. Frames not passed to OnFrame are not passed either. It can be changed with Reconfig.
+	OnKeyframe func(pts int64)
+	// Called after each x264 encode call with the wall-clock time spent in it, including calls that output
+	// no frame and flushing calls. It can be changed with Reconfig.
+	OnEncodeTime func(d time.Duration)
+	// Called every TelemetryInterval encoded frames with the rolling bitrate and VBV buffer estimate.
+	// It can be changed with Reconfig.
+	Telemetry func(TelemetrySnapshot)
+	// Frames between Telemetry calls. Zero means FrameRate, one call per second of video.
+	TelemetryInterval int
+	// Receives a second stream holding the alpha of *image.RGBA and *image.NRGBA images as ColorSpaceI400 luma,
+	// other images are encoded opaque. H.264 defines auxiliary alpha pictures but x264 cannot code them, both streams
+	// are plain H.264 and the player has to pair frames by PTS. The alpha stream uses the other options with
+	// baseline and main raised to high profile, and requires x264 built with all chroma formats, see BuildInfo.
+	// Frames encoded from raw planes are not added. It is kept on Reconfig.
+	AlphaWriter io.Writer
 }
 
-// Encoder type.
+// Encoder type. It is not safe for concurrent use, calls must not overlap.
 type Encoder struct {
 	e *x264c.T
 	w io.Writer
@@ -49,61 +394,382 @@ type Encoder struct {
 	img  *YCbCr
 	opts *Options
 
-	csp int32
+	csp   int32
+	depth int
+
+	// encoded dimensions, differ from options for padded odd 4:2:0 sizes
+	width  int
+	height int
+
 	pts int64
 
 	nnals int32
 	nals  []*x264c.Nal
 
 	picIn x264c.Picture
+	// parameters the encoder was opened with
+	param *x264c.Param
+	// last output picture, its reconstructed planes are valid until the next encode call
+	picOut *x264c.Picture
+
+	// interleaved chroma plane for NV12
+	cbcr []byte
+
+	// C plane buffers for image input, reused for every frame
+	cplanes    [3]unsafe.Pointer
+	cplanesLen [3]int
+
+	// forced type of the next picture
+	nextType FrameType
+
+	// PTS values of pictures forced to IDR, scheduled with ScheduleKeyframes
+	keyframes map[int64]struct{}
+
+	// forced quantizer plus one for the next picture, 0 is auto
+	qpplus1 int32
+
+	closed bool
+
+	// pending SEI user data payload
+	sei []byte
+
+	// quantizer offsets for the next picture, one per macroblock
+	quantOffsets []float32
+
+	// chroma planes hold neutral gray
+	grayChroma bool
 
 	tpf int64
+
+	// CFR conversion origin, the input timestamp and frame number of the first EncodeWithPTS call
+	cfrStarted bool
+	cfrStart   int64
+	cfrBase    int64
+	// the last picture came from raw planes, held in cplanes for CFR repeats
+	rawLast bool
+
+	stats stats
+	// stream bytes written, stream headers included, and frames written
+	written       int64
+	writtenFrames int64
+
+	// stream of NewReaderEncoder, ended on Close
+	ring *ringBuffer
+
+	// additional writers added with AddWriter
+	writers []io.Writer
+
+	// encoder of the AlphaWriter stream and the alpha of the last image
+	alpha    *Encoder
+	alphaImg *image.Gray
+
+	// C allocated id of the registered Logger
+	logID *C.int
+
+	// C string of the two-pass stats file name, referenced by param
+	statsFile *C.char
 }
 
-// NewEncoder returns new x264 encoder.
+// NewEncoder returns new x264 encoder. A nil w discards the stream, i.e. to measure pure encoding throughput,
+// writers added with AddWriter still receive it.
 func NewEncoder(w io.Writer, opts *Options) (e *Encoder, err error) {
+	err = opts.Validate()
+	if err != nil {
+		return
+	}
+
 	e = &Encoder{}
 
+	o := *opts
+
 	e.w = w
 	e.pts = 0
-	e.opts = opts
-
-	e.csp = x264c.CspI420
+	e.opts = &o
 
 	e.nals = make([]*x264c.Nal, 3)
-	e.img = NewYCbCr(image.Rect(0, 0, e.opts.Width, e.opts.Height))
+	e.picOut = &x264c.Picture{}
+
+	switch e.opts.ColorSpace {
+	case ColorSpaceI420:
+		e.csp = x264c.CspI420
+	case ColorSpaceNV12:
+		e.csp = x264c.CspNv12
+	case ColorSpaceI422:
+		e.csp = x264c.CspI422
+	case ColorSpaceI444:
+		e.csp = x264c.CspI444
+	case ColorSpaceI400:
+		e.csp = x264c.CspI400
+	default:
+		err = errorf(ErrInvalidOptions, "x264: invalid color space %d", e.opts.ColorSpace)
+		return
+	}
+
+	e.allocImage()
 
 	param := x264c.Param{}
 
 	if e.opts.Preset != "" && e.opts.Profile != "" {
 		ret := x264c.ParamDefaultPreset(&param, e.opts.Preset, e.opts.Tune)
 		if ret < 0 {
-			err = fmt.Errorf("x264: invalid preset/tune name")
+			err = errorf(ErrInvalidPreset, "x264: invalid preset/tune name")
 			return
 		}
 	} else {
 		x264c.ParamDefault(&param)
 	}
 
-	param.IWidth = int32(e.opts.Width)
-	param.IHeight = int32(e.opts.Height)
+	param.IWidth = int32(e.width)
+	param.IHeight = int32(e.height)
+	param.CropRect = x264c.CropRect{
+		Left:   uint32(e.opts.CropLeft),
+		Top:    uint32(e.opts.CropTop),
+		Right:  uint32(e.opts.CropRight),
+		Bottom: uint32(e.opts.CropBottom),
+	}
 	param.ICsp = e.csp
 	param.ILogLevel = e.opts.LogLevel
-	param.IBitdepth = 8
+
+	if l, ok := findLevel(e.opts.Level); ok {
+		param.ILevelIdc = int32(l.idc)
+	}
+
+	e.depth = e.opts.BitDepth
+	if e.depth == 0 {
+		e.depth = 8
+	}
+
+	param.IBitdepth = int32(e.depth)
+
+	// psnr and ssim tunings only adjust psy and AQ, enable computation of the metrics for Stats.
+	// x264 skips the metrics when log level is below info.
+	if contains(e.opts.tuneList(), "psnr") {
+		param.Analyse.BPsnr = 1
+	}
+	if contains(e.opts.tuneList(), "ssim") {
+		param.Analyse.BSsim = 1
+	}
+
+	if e.opts.Threads > 0 {
+		param.IThreads = int32(e.opts.Threads)
+	}
+
+	if e.opts.SlicedThreads {
+		param.BSlicedThreads = 1
+	}
+
+	if e.opts.Deterministic {
+		param.IThreads = 1
+		param.ILookaheadThreads = 1
+		param.BDeterministic = 1
+		param.BCpuIndependent = 1
+	}
+
+	if e.opts.SliceMaxSize > 0 {
+		param.ISliceMaxSize = int32(e.opts.SliceMaxSize)
+	}
+
+	if e.opts.Slices > 0 {
+		param.ISliceCount = int32(e.opts.Slices)
+	}
 
 	param.BVfrInput = 0
+	if e.opts.VFR {
+		param.BVfrInput = 1
+		if e.opts.Timebase > 0 {
+			param.ITimebaseNum = 1
+			param.ITimebaseDen = uint32(e.opts.Timebase)
+		}
+	}
+
+	if e.opts.Interlaced {
+		param.BInterlaced = 1
+		param.BTff = 1
+		if e.opts.BottomFieldFirst {
+			param.BTff = 0
+		}
+	}
+
 	param.BRepeatHeaders = 1
-	param.BAnnexb = 1
+	if e.opts.NoRepeatHeaders {
+		param.BRepeatHeaders = 0
+	}
+
+	if e.opts.AUD {
+		param.BAud = 1
+	}
+
+	switch e.opts.NALFormat {
+	case NALFormatAnnexB:
+		param.BAnnexb = 1
+	case NALFormatAVCC:
+		param.BAnnexb = 0
+	default:
+		err = errorf(ErrInvalidOptions, "x264: invalid NAL format %d", e.opts.NALFormat)
+		return
+	}
 
-	param.BIntraRefresh = 1
+	if e.opts.IntraRefresh {
+		param.BIntraRefresh = 1
+	}
 	param.IKeyintMax = int32(e.opts.FrameRate)
+	if e.opts.KeyintMax > 0 {
+		param.IKeyintMax = int32(e.opts.KeyintMax)
+	}
+
+	if e.opts.KeyintMin > 0 {
+		param.IKeyintMin = int32(e.opts.KeyintMin)
+	}
+
+	if e.opts.OpenGOP {
+		param.BOpenGop = 1
+	}
+
+	if e.opts.SceneCut > 0 {
+		param.IScenecutThreshold = int32(e.opts.SceneCut)
+	} else if e.opts.SceneCut < 0 {
+		param.IScenecutThreshold = 0
+	}
+
+	if e.opts.BFrames > 0 {
+		param.IBframe = int32(e.opts.BFrames)
+	} else if e.opts.BFrames < 0 {
+		param.IBframe = 0
+	}
+
+	switch e.opts.BFrameAdaptive {
+	case BFrameAdaptiveDefault:
+	case BFrameAdaptiveNone:
+		param.IBframeAdaptive = x264c.BAdaptNone
+	case BFrameAdaptiveFast:
+		param.IBframeAdaptive = x264c.BAdaptFast
+	case BFrameAdaptiveTrellis:
+		param.IBframeAdaptive = x264c.BAdaptTrellis
+	}
+
+	if e.opts.RefFrames > 0 {
+		param.IFrameReference = int32(e.opts.RefFrames)
+	}
+
+	if e.opts.DPBSize > 0 {
+		param.IDpbSize = int32(e.opts.DPBSize)
+	}
+
+	switch e.opts.Entropy {
+	case EntropyDefault:
+	case EntropyCABAC:
+		param.BCabac = 1
+	case EntropyCAVLC:
+		param.BCabac = 0
+	}
+
+	switch e.opts.CQMPreset {
+	case CQMDefault:
+	case CQMFlat:
+		param.ICqmPreset = x264c.CqmFlat
+	case CQMJVT:
+		param.ICqmPreset = x264c.CqmJvt
+	}
+
+	if m := e.opts.CQM; m != nil {
+		param.ICqmPreset = x264c.CqmCustom
+		param.Cqm4iy, param.Cqm4py = m.Intra4x4Luma, m.Inter4x4Luma
+		param.Cqm4ic, param.Cqm4pc = m.Intra4x4Chroma, m.Inter4x4Chroma
+		param.Cqm8iy, param.Cqm8py = m.Intra8x8Luma, m.Inter8x8Luma
+		param.Cqm8ic, param.Cqm8pc = m.Intra8x8Chroma, m.Inter8x8Chroma
+	}
+
+	switch e.opts.AQMode {
+	case AQModeDefault:
+	case AQModeNone:
+		param.Rc.IAqMode = x264c.AqNone
+	case AQModeVariance:
+		param.Rc.IAqMode = x264c.AqVariance
+	case AQModeAutoVariance:
+		param.Rc.IAqMode = x264c.AqAutovariance
+	case AQModeAutoVarianceBiased:
+		param.Rc.IAqMode = x264c.AqAutovarianceBiased
+	}
+
+	if e.opts.AQStrength > 0 {
+		param.Rc.FAqStrength = e.opts.AQStrength
+	}
+
+	if e.opts.PsyRD > 0 {
+		param.Analyse.FPsyRd = e.opts.PsyRD
+	} else if e.opts.PsyRD < 0 {
+		param.Analyse.FPsyRd = 0
+	}
+
+	if e.opts.PsyTrellis > 0 {
+		param.Analyse.FPsyTrellis = e.opts.PsyTrellis
+	} else if e.opts.PsyTrellis < 0 {
+		param.Analyse.FPsyTrellis = 0
+	}
+
+	if e.opts.DisablePsy {
+		param.Analyse.BPsy = 0
+		param.Analyse.FPsyRd = 0
+		param.Analyse.FPsyTrellis = 0
+	}
+
+	if e.opts.DeblockAlpha != 0 || e.opts.DeblockBeta != 0 {
+		param.IDeblockingFilterAlphac0 = int32(e.opts.DeblockAlpha)
+		param.IDeblockingFilterBeta = int32(e.opts.DeblockBeta)
+	}
+
+	if e.opts.RCLookahead > 0 {
+		param.Rc.ILookahead = int32(e.opts.RCLookahead)
+	} else if e.opts.RCLookahead < 0 {
+		param.Rc.ILookahead = 0
+	}
+
+	if e.opts.NoMBTree {
+		param.Rc.BMbTree = 0
+	}
+
+	err = applyVUI(&param, e.opts)
+	if err != nil {
+		return
+	}
+
 	param.IFpsNum = uint32(e.opts.FrameRate)
 	param.IFpsDen = 1
 
+	err = applyRateControl(&param, e.opts)
+	if err != nil {
+		return
+	}
+
+	if e.opts.Pass > 0 {
+		statsFile := e.opts.StatsFile
+		if statsFile == "" {
+			statsFile = "x264_2pass.log"
+		}
+		e.statsFile = C.CString(statsFile)
+
+		if e.opts.Pass == 1 {
+			param.Rc.BStatWrite = 1
+			param.Rc.PszStatOut = (*int8)(unsafe.Pointer(e.statsFile))
+		} else {
+			param.Rc.BStatRead = 1
+			param.Rc.PszStatIn = (*int8)(unsafe.Pointer(e.statsFile))
+		}
+	}
+
+	err = applyExtra(&param, e.opts.Extra)
+	if err != nil {
+		x264c.ParamCleanup(&param)
+		e.freeStatsFile()
+		return
+	}
+
 	if e.opts.Profile != "" {
 		ret := x264c.ParamApplyProfile(&param, e.opts.Profile)
 		if ret < 0 {
-			err = fmt.Errorf("x264: invalid profile name")
+			err = errorf(ErrInvalidPreset, "x264: invalid profile name")
+			x264c.ParamCleanup(&param)
+			e.freeStatsFile()
 			return
 		}
 	}
@@ -112,123 +778,1949 @@ func NewEncoder(w io.Writer, opts *Options) (e *Encoder, err error) {
 	x264c.PictureInit(&picIn)
 	e.picIn = picIn
 
+	if e.opts.Logger != nil {
+		e.setLogger(&param)
+	}
+
+	e.param = &param
+
+	err = e.open(!e.opts.DeferHeaders)
+	if err != nil {
+		if e.e != nil {
+			x264c.EncoderClose(e.e)
+			e.e = nil
+		}
+
+		e.freeLogger()
+		e.freeStatsFile()
+		x264c.ParamCleanup(e.param)
+		return
+	}
+
+	e.allocPlanes()
+
+	if e.opts.AlphaWriter != nil {
+		e.alpha, err = NewEncoder(e.opts.AlphaWriter, e.opts.alphaOptions())
+		if err != nil {
+			e.release()
+			return
+		}
+	}
+
+	return
+}
+
+// open opens x264 encoder with the prepared parameters and writes the stream headers if headers is set.
+func (e *Encoder) open(headers bool) (err error) {
+	param := *e.param
+
 	e.e = x264c.EncoderOpen(&param)
 	if e.e == nil {
-		err = fmt.Errorf("x264: cannot open the encoder")
+		err = errorf(ErrEncoderOpen, "x264: cannot open the encoder")
+		return
+	}
+
+	if headers {
+		err = e.WriteHeaders()
+	}
+
+	return
+}
+
+// WriteHeaders writes the SPS and PPS, with the x264 version SEI, to the writer.
+// NewEncoder and Reset write them unless DeferHeaders is set.
+func (e *Encoder) WriteHeaders() (err error) {
+	if e.e == nil {
+		err = ErrClosed
 		return
 	}
 
 	ret := x264c.EncoderHeaders(e.e, e.nals, &e.nnals)
-	if ret < 0 {
-		err = fmt.Errorf("x264: cannot encode headers")
+	switch resultOf(ret) {
+	case resultError:
+		err = errorf(ErrEncode, "x264: cannot encode headers")
+	case resultOutput:
+		err = e.write(C.GoBytes(e.nals[0].PPayload, C.int(ret)))
+	}
+
+	return
+}
+
+// Reset flushes delayed frames and reopens the encoder with the same options, the new stream is written to w.
+// PTS restarts at 0 and statistics are cleared, image and plane buffers are reused. A nil w discards the stream.
+func (e *Encoder) Reset(w io.Writer) (err error) {
+	err = e.Flush()
+	if err != nil {
 		return
 	}
 
-	if ret > 0 {
-		b := C.GoBytes(e.nals[0].PPayload, C.int(ret))
-		n, er := e.w.Write(b)
-		if er != nil {
-			err = er
-			return
-		}
+	x264c.EncoderClose(e.e)
+	e.e = nil
 
-		if int(ret) != n {
-			err = fmt.Errorf("x264: error writing headers, size=%d, n=%d", ret, n)
-		}
+	e.w = w
+	e.pts = 0
+	e.cfrStarted = false
+	e.nextType = FrameAuto
+	e.keyframes = nil
+	e.sei = nil
+	e.stats = stats{}
+	e.written, e.writtenFrames = 0, 0
+
+	err = e.open(!e.opts.DeferHeaders)
+	if err != nil {
+		return
+	}
+
+	if e.alpha != nil {
+		err = e.alpha.Reset(e.opts.AlphaWriter)
 	}
 
 	return
 }
 
-// Encode encodes image.
-func (e *Encoder) Encode(im image.Image) (err error) {
-	var picOut x264c.Picture
-
-	_, rgba := im.(*image.RGBA)
-	if rgba {
-		e.img.ToYCbCr(im)
-	} else {
-		e.img.ToYCbCrDraw(im)
+// FlushPartial flushes delayed frames and keeps encoding into the same stream, i.e. at segment boundaries.
+// x264 takes no frames after a flush, so it is reopened with the same options and the next frame is always an IDR frame,
+// carrying SPS and PPS unless NoRepeatHeaders is set. PTS, statistics and writers are kept, rate control restarts.
+// With B-frames the first DTS after the flush can precede the last one before it, as at the start of a stream.
+// It cannot be used with two-pass encoding.
+func (e *Encoder) FlushPartial() (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
 	}
 
-	picIn := e.picIn
+	if e.opts.Pass > 0 {
+		err = errorf(ErrInvalidOptions, "x264: FlushPartial cannot be used with two-pass encoding")
+		return
+	}
 
-	picIn.Img.ICsp = e.csp
+	err = e.Flush()
+	if err != nil {
+		return
+	}
 
-	picIn.Img.IPlane = 3
-	picIn.Img.IStride[0] = int32(e.opts.Width)
-	picIn.Img.IStride[1] = int32(e.opts.Width) / 2
-	picIn.Img.IStride[2] = int32(e.opts.Width) / 2
+	x264c.EncoderClose(e.e)
+	e.e = nil
 
-	picIn.Img.Plane[0] = C.CBytes(e.img.Y)
-	picIn.Img.Plane[1] = C.CBytes(e.img.Cb)
-	picIn.Img.Plane[2] = C.CBytes(e.img.Cr)
+	err = e.open(false)
+	if err != nil {
+		return
+	}
 
-	picIn.IPts = e.pts
-	e.pts++
+	if e.alpha != nil {
+		err = e.alpha.FlushPartial()
+	}
 
-	defer func() {
-		picIn.FreePlane(0)
-		picIn.FreePlane(1)
-		picIn.FreePlane(2)
-	}()
+	return
+}
 
-	ret := x264c.EncoderEncode(e.e, e.nals, &e.nnals, &picIn, &picOut)
-	if ret < 0 {
-		err = fmt.Errorf("x264: cannot encode picture")
+// Warmup fills the image and plane buffers with mid-gray, so the first frame does not pay for the page faults of
+// touching them. x264 is not called, its first frame setup and the first keyframe still happen on the first frame.
+// Nothing is written, PTS and statistics are kept and the stream is the same as without Warmup.
+// It must be called before the first frame.
+func (e *Encoder) Warmup() (err error) {
+	if e.e == nil {
+		err = ErrClosed
 		return
 	}
 
-	if ret > 0 {
-		b := C.GoBytes(e.nals[0].PPayload, C.int(ret))
+	if e.stats.Frames > 0 || x264c.EncoderDelayedFrames(e.e) > 0 {
+		err = errorf(ErrInvalidInput, "x264: Warmup must be called before the first frame")
+		return
+	}
 
-		n, er := e.w.Write(b)
-		if er != nil {
-			err = er
-			return
+	for _, p := range [][]byte{e.img.Y, e.img.Cb, e.img.Cr, e.cbcr} {
+		for i := range p {
+			p[i] = 0x80
 		}
+	}
 
-		if int(ret) != n {
-			err = fmt.Errorf("x264: error writing payload, size=%d, n=%d", ret, n)
+	for i := range e.cplanes {
+		if e.cplanes[i] != nil {
+			C.memset(e.cplanes[i], 0x80, C.size_t(e.cplanesLen[i]))
 		}
 	}
 
+	if e.alpha != nil {
+		err = e.alpha.Warmup()
+	}
+
 	return
 }
 
-// Flush flushes encoder.
-func (e *Encoder) Flush() (err error) {
-	var picOut x264c.Picture
+// ChangeResolution flushes delayed frames and reopens the encoder for width x height images, i.e. when a screen
+// share source is resized. x264 cannot resize an open encoder, so image and plane buffers are reallocated, new SPS and
+// PPS are written and the next frame is an IDR frame. Decoders and muxers downstream must accept new headers mid-stream,
+// containers that store them once need a new file or segment. PTS, statistics, frame requests and writers are kept,
+// rate control restarts. It cannot be used with two-pass encoding.
+func (e *Encoder) ChangeResolution(width, height int) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
 
-	for x264c.EncoderDelayedFrames(e.e) > 0 {
-		ret := x264c.EncoderEncode(e.e, e.nals, &e.nnals, nil, &picOut)
-		if ret < 0 {
-			err = fmt.Errorf("x264: cannot encode picture")
-			return
-		}
+	if e.opts.Pass > 0 {
+		err = errorf(ErrInvalidOptions, "x264: ChangeResolution cannot be used with two-pass encoding")
+		return
+	}
 
-		if ret > 0 {
-			b := C.GoBytes(e.nals[0].PPayload, C.int(ret))
+	opts := *e.opts
+	opts.Width, opts.Height = width, height
 
-			n, er := e.w.Write(b)
-			if er != nil {
-				err = er
-				return
-			}
+	err = opts.Validate()
+	if err != nil {
+		return
+	}
 
-			if int(ret) != n {
-				err = fmt.Errorf("x264: error writing payload, size=%d, n=%d", ret, n)
-			}
-		}
+	err = e.Flush()
+	if err != nil {
+		return
 	}
 
-	return
-}
+	x264c.EncoderClose(e.e)
+	e.e = nil
 
-// Close closes encoder.
-func (e *Encoder) Close() error {
+	for i := range e.cplanes {
+		C.free(e.cplanes[i])
+		e.cplanes[i] = nil
+	}
+
+	e.opts = &opts
+	e.allocImage()
+	e.allocPlanes()
+	e.grayChroma = false
+
+	e.param.IWidth = int32(e.width)
+	e.param.IHeight = int32(e.height)
+
+	// headers are written to the added writers too
+	err = e.open(true)
+	if err != nil {
+		return
+	}
+
+	if e.alpha != nil {
+		err = e.alpha.ChangeResolution(width, height)
+	}
+
+	return
+}
+
+// NewBufferEncoder returns new x264 encoder writing the stream to the returned buffer.
+func NewBufferEncoder(opts *Options) (e *Encoder, buf *bytes.Buffer, err error) {
+	buf = new(bytes.Buffer)
+
+	e, err = NewEncoder(buf, opts)
+	if err != nil {
+		buf = nil
+	}
+
+	return
+}
+
+// EncodeImage encodes im as a standalone stream of a single IDR frame with SPS and PPS.
+// The encoder is opened with opts and closed before returning.
+func EncodeImage(im image.Image, opts *Options) (b []byte, err error) {
+	o := *opts
+	// headers are carried by the IDR frame unless they are not repeated
+	o.DeferHeaders = !o.NoRepeatHeaders
+
+	e, buf, err := NewBufferEncoder(&o)
+	if err != nil {
+		return
+	}
+
+	e.ForceKeyframe()
+
+	err = e.Encode(im)
+	if err != nil {
+		e.Close()
+		return
+	}
+
+	err = e.Close()
+	if err != nil {
+		return
+	}
+
+	b = buf.Bytes()
+	return
+}
+
+// NewReaderEncoder returns new x264 encoder and a reader of its stream.
+// Encode calls block while the reader falls behind by more than 1 MiB of stream,
+// and fail with io.ErrClosedPipe once the reader is closed. Reads return io.EOF after the encoder is closed.
+func NewReaderEncoder(opts *Options) (e *Encoder, r io.ReadCloser, err error) {
+	ring := newRingBuffer(readerBufferSize)
+
+	e, err = NewEncoder(ring, opts)
+	if err != nil {
+		return
+	}
+
+	e.ring = ring
+	r = ring
+
+	return
+}
+
+// applyVUI maps color signaling options onto param VUI.
+func applyVUI(param *x264c.Param, opts *Options) error {
+	switch opts.ColorRange {
+	case ColorRangeDefault:
+	case ColorRangeLimited:
+		param.Vui.BFullrange = 0
+	case ColorRangeFull:
+		param.Vui.BFullrange = 1
+	default:
+		return errorf(ErrInvalidOptions, "x264: invalid color range %d", opts.ColorRange)
+	}
+
+	for _, v := range []struct{ name, value string }{
+		{"colorprim", opts.ColorPrimaries},
+		{"transfer", opts.TransferCharacteristics},
+		{"colormatrix", opts.ColorMatrix},
+	} {
+		if v.value == "" {
+			continue
+		}
+
+		if x264c.ParamParse(param, v.name, v.value) < 0 {
+			return errorf(ErrInvalidOptions, "x264: invalid %s %q", v.name, v.value)
+		}
+	}
+
+	return nil
+}
+
+// applyRateControl maps rate control options onto param.
+func applyRateControl(param *x264c.Param, opts *Options) error {
+	switch opts.RateControl {
+	case RateControlDefault:
+	case RateControlCQP:
+		if opts.QP < 0 || opts.QP > 51 {
+			return errorf(ErrInvalidOptions, "x264: invalid qp %d", opts.QP)
+		}
+		param.Rc.IRcMethod = x264c.RcCqp
+		param.Rc.IQpConstant = int32(opts.QP)
+
+		// x264 derives I and B quantizers from QP with ip and pb factors
+		if opts.QPI > 0 {
+			param.Rc.FIpFactor = float32(math.Pow(2, float64(opts.QP-opts.QPI)/6))
+		}
+		if opts.QPB > 0 {
+			param.Rc.FPbFactor = float32(math.Pow(2, float64(opts.QPB-opts.QP)/6))
+		}
+	case RateControlCRF:
+		param.Rc.IRcMethod = x264c.RcCrf
+		if opts.CRF != 0 {
+			param.Rc.FRfConstant = opts.CRF
+		}
+	case RateControlABR:
+		if opts.Bitrate <= 0 {
+			return errorf(ErrInvalidOptions, "x264: bitrate is required for ABR rate control")
+		}
+		param.Rc.IRcMethod = x264c.RcAbr
+		param.Rc.IBitrate = int32(opts.Bitrate)
+	default:
+		return errorf(ErrInvalidOptions, "x264: invalid rate control method %d", opts.RateControl)
+	}
+
+	if opts.VBVMaxRate > 0 {
+		param.Rc.IVbvMaxBitrate = int32(opts.VBVMaxRate)
+	}
+
+	if opts.VBVBufferSize > 0 {
+		param.Rc.IVbvBufferSize = int32(opts.VBVBufferSize)
+	}
+
+	return nil
+}
+
+// applyExtra applies x264 parameters by name, in name order.
+func applyExtra(param *x264c.Param, extra map[string]string) error {
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch x264c.ParamParse(param, name, extra[name]) {
+		case 0:
+		case x264c.ParamBadName:
+			return errorf(ErrInvalidOptions, "x264: invalid Extra %q, unknown parameter", name)
+		default:
+			return errorf(ErrInvalidOptions, "x264: invalid Extra %q value %q", name, extra[name])
+		}
+	}
+
+	return nil
+}
+
+// Headers returns the SPS and PPS NAL units used for the stream, without start codes.
+// Nothing is written to the writer.
+func (e *Encoder) Headers() (sps, pps []byte, err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	ret := x264c.EncoderHeaders(e.e, e.nals, &e.nnals)
+	if ret < 0 {
+		err = errorf(ErrEncode, "x264: cannot encode headers")
+		return
+	}
+
+	for _, nal := range e.nalUnits() {
+		switch nal.IType {
+		case x264c.NalSps:
+			sps = e.nalPayload(&nal)
+		case x264c.NalPps:
+			pps = e.nalPayload(&nal)
+		}
+	}
+
+	if sps == nil || pps == nil {
+		err = errorf(ErrEncode, "x264: missing SPS/PPS in headers")
+	}
+
+	return
+}
+
+// nalUnits returns NAL units returned by the last EncoderHeaders or EncoderEncode call.
+func (e *Encoder) nalUnits() []x264c.Nal {
+	if e.nnals == 0 {
+		return nil
+	}
+
+	return (*[1 << 16]x264c.Nal)(unsafe.Pointer(e.nals[0]))[:e.nnals:e.nnals]
+}
+
+// nalPayload returns a copy of NAL unit payload without the start code or length prefix.
+func (e *Encoder) nalPayload(nal *x264c.Nal) []byte {
+	return C.GoBytes(nal.PPayload, C.int(nal.IPayload))[e.nalPrefix(nal):]
+}
+
+// nalPrefix returns the size of NAL unit start code or length prefix.
+func (e *Encoder) nalPrefix(nal *x264c.Nal) int {
+	if e.opts.NALFormat == NALFormatAnnexB && nal.BLongStartcode == 0 {
+		return 3
+	}
+
+	return 4
+}
+
+// Reconfig changes encoding options of the running encoder.
+//
+// Only CRF, Bitrate, VBVMaxRate and VBVBufferSize can change mid-stream, Bitrate and VBV settings only when VBV was enabled
+// in NewEncoder. Other fields, e.g. Width, Height, FrameRate or Profile, require a new encoder and Reconfig returns an error if they changed.
+func (e *Encoder) Reconfig(opts *Options) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	if name := e.opts.fixedFieldChanged(opts); name != "" {
+		err = errorf(ErrInvalidOptions, "x264: %s cannot be changed without reopening the encoder", name)
+		return
+	}
+
+	vbv := e.opts.VBVMaxRate > 0 && e.opts.VBVBufferSize > 0
+	if !vbv && (opts.Bitrate != e.opts.Bitrate || opts.VBVMaxRate != e.opts.VBVMaxRate || opts.VBVBufferSize != e.opts.VBVBufferSize) {
+		err = errorf(ErrInvalidOptions, "x264: bitrate and VBV can only be changed when VBV is enabled")
+		return
+	}
+
+	param := x264c.Param{}
+	x264c.EncoderParameters(e.e, &param)
+
+	err = applyRateControl(&param, opts)
+	if err != nil {
+		return
+	}
+
+	ret := x264c.EncoderReconfig(e.e, &param)
+	if ret < 0 {
+		err = errorf(ErrEncode, "x264: cannot reconfigure the encoder")
+		return
+	}
+
+	// keep the new rate control for Reset
+	err = applyRateControl(e.param, opts)
+	if err != nil {
+		return
+	}
+
+	o := *opts
+	o.Logger = e.opts.Logger
+	o.AlphaWriter = e.opts.AlphaWriter
+	e.opts = &o
+
+	if e.alpha != nil {
+		err = e.alpha.Reconfig(o.alphaOptions())
+	}
+
+	return
+}
+
+// Options returns a copy of the encoder options, including changes applied by Reconfig.
+func (e *Encoder) Options() Options {
+	return *e.opts
+}
+
+// EffectiveParams represents the parameters x264 encodes with, after preset, tune, profile and options are applied.
+type EffectiveParams struct {
+	// Encoded size, odd 4:2:0 sizes are padded.
+	Width  int
+	Height int
+	// Color space as in Options.
+	ColorSpace int32
+	BitDepth   int
+	// H.264 level, i.e. "4.1".
+	Level string
+	// Maximum IDR interval in frames, zero if unlimited, and minimum IDR interval.
+	KeyintMax int
+	KeyintMin int
+	BFrames   int
+	RefFrames int
+	// Rate control method: RateControlCQP, RateControlCRF, RateControlABR.
+	RateControl int32
+	QP          int
+	CRF         float32
+	// Bitrate, VBV maximum rate in kbps and VBV buffer size in kbit, zero if unused.
+	Bitrate       int
+	VBVMaxRate    int
+	VBVBufferSize int
+	// Rate control lookahead in frames and whether macroblock-tree rate control is used.
+	RCLookahead int
+	MBTree      bool
+	CABAC       bool
+	// Frame and lookahead threads, and whether threads encode slices of the same frame.
+	Threads          int
+	LookaheadThreads int
+	SlicedThreads    bool
+}
+
+// EffectiveParams returns the parameters of the open encoder, i.e. to log the true configuration.
+// It returns zero EffectiveParams if the encoder is closed.
+func (e *Encoder) EffectiveParams() (p EffectiveParams) {
+	if e.e == nil {
+		return
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(e.e, &param)
+
+	p = EffectiveParams{
+		Width:            int(param.IWidth),
+		Height:           int(param.IHeight),
+		BitDepth:         int(param.IBitdepth),
+		Level:            levelName(int(param.ILevelIdc)),
+		KeyintMax:        int(param.IKeyintMax),
+		KeyintMin:        int(param.IKeyintMin),
+		BFrames:          int(param.IBframe),
+		RefFrames:        int(param.IFrameReference),
+		QP:               int(param.Rc.IQpConstant),
+		CRF:              param.Rc.FRfConstant,
+		Bitrate:          int(param.Rc.IBitrate),
+		VBVMaxRate:       int(param.Rc.IVbvMaxBitrate),
+		VBVBufferSize:    int(param.Rc.IVbvBufferSize),
+		RCLookahead:      int(param.Rc.ILookahead),
+		MBTree:           param.Rc.BMbTree != 0,
+		CABAC:            param.BCabac != 0,
+		Threads:          int(param.IThreads),
+		LookaheadThreads: int(param.ILookaheadThreads),
+		SlicedThreads:    param.BSlicedThreads != 0,
+	}
+
+	if p.KeyintMax == x264c.KeyintMaxInfinite {
+		p.KeyintMax = 0
+	}
+
+	switch param.ICsp & x264c.CspMask {
+	case x264c.CspI420:
+		p.ColorSpace = ColorSpaceI420
+	case x264c.CspNv12:
+		p.ColorSpace = ColorSpaceNV12
+	case x264c.CspI422:
+		p.ColorSpace = ColorSpaceI422
+	case x264c.CspI444:
+		p.ColorSpace = ColorSpaceI444
+	case x264c.CspI400:
+		p.ColorSpace = ColorSpaceI400
+	}
+
+	switch param.Rc.IRcMethod {
+	case x264c.RcCqp:
+		p.RateControl = RateControlCQP
+	case x264c.RcCrf:
+		p.RateControl = RateControlCRF
+	case x264c.RcAbr:
+		p.RateControl = RateControlABR
+	}
+
+	return
+}
+
+// fixedFieldChanged returns the name of the first field that differs between o and n and cannot be reconfigured.
+func (o *Options) fixedFieldChanged(n *Options) string {
+	switch {
+	case o.Width != n.Width:
+		return "Width"
+	case o.Height != n.Height:
+		return "Height"
+	case o.CropLeft != n.CropLeft, o.CropTop != n.CropTop, o.CropRight != n.CropRight, o.CropBottom != n.CropBottom:
+		return "Crop"
+	case o.FrameRate != n.FrameRate:
+		return "FrameRate"
+	case o.Tune != n.Tune:
+		return "Tune"
+	case o.Preset != n.Preset:
+		return "Preset"
+	case o.Profile != n.Profile:
+		return "Profile"
+	case o.Level != n.Level:
+		return "Level"
+	case o.LogLevel != n.LogLevel:
+		return "LogLevel"
+	case o.RateControl != n.RateControl:
+		return "RateControl"
+	case o.QP != n.QP:
+		return "QP"
+	case o.Pass != n.Pass:
+		return "Pass"
+	case o.StatsFile != n.StatsFile:
+		return "StatsFile"
+	case o.QPI != n.QPI:
+		return "QPI"
+	case o.QPB != n.QPB:
+		return "QPB"
+	case o.ColorSpace != n.ColorSpace:
+		return "ColorSpace"
+	case o.NALFormat != n.NALFormat:
+		return "NALFormat"
+	case o.NoRepeatHeaders != n.NoRepeatHeaders:
+		return "NoRepeatHeaders"
+	case o.AUD != n.AUD:
+		return "AUD"
+	case o.BitDepth != n.BitDepth:
+		return "BitDepth"
+	case o.VFR != n.VFR:
+		return "VFR"
+	case o.Timebase != n.Timebase:
+		return "Timebase"
+	case o.CFR != n.CFR:
+		return "CFR"
+	case o.Interlaced != n.Interlaced:
+		return "Interlaced"
+	case o.BottomFieldFirst != n.BottomFieldFirst:
+		return "BottomFieldFirst"
+	case o.KeyintMax != n.KeyintMax:
+		return "KeyintMax"
+	case o.KeyintMin != n.KeyintMin:
+		return "KeyintMin"
+	case o.OpenGOP != n.OpenGOP:
+		return "OpenGOP"
+	case o.SceneCut != n.SceneCut:
+		return "SceneCut"
+	case o.Threads != n.Threads:
+		return "Threads"
+	case o.SlicedThreads != n.SlicedThreads:
+		return "SlicedThreads"
+	case o.Deterministic != n.Deterministic:
+		return "Deterministic"
+	case o.SliceMaxSize != n.SliceMaxSize:
+		return "SliceMaxSize"
+	case o.Slices != n.Slices:
+		return "Slices"
+	case o.BFrames != n.BFrames:
+		return "BFrames"
+	case o.BFrameAdaptive != n.BFrameAdaptive:
+		return "BFrameAdaptive"
+	case o.RefFrames != n.RefFrames:
+		return "RefFrames"
+	case o.DPBSize != n.DPBSize:
+		return "DPBSize"
+	case o.Entropy != n.Entropy:
+		return "Entropy"
+	case o.CQMPreset != n.CQMPreset:
+		return "CQMPreset"
+	case (o.CQM == nil) != (n.CQM == nil) || (o.CQM != nil && *o.CQM != *n.CQM):
+		return "CQM"
+	case o.AQMode != n.AQMode:
+		return "AQMode"
+	case o.AQStrength != n.AQStrength:
+		return "AQStrength"
+	case o.PsyRD != n.PsyRD:
+		return "PsyRD"
+	case o.PsyTrellis != n.PsyTrellis:
+		return "PsyTrellis"
+	case o.DisablePsy != n.DisablePsy:
+		return "DisablePsy"
+	case o.DeblockAlpha != n.DeblockAlpha:
+		return "DeblockAlpha"
+	case o.DeblockBeta != n.DeblockBeta:
+		return "DeblockBeta"
+	case o.RCLookahead != n.RCLookahead:
+		return "RCLookahead"
+	case o.NoMBTree != n.NoMBTree:
+		return "NoMBTree"
+	case o.IntraRefresh != n.IntraRefresh:
+		return "IntraRefresh"
+	case o.ColorRange != n.ColorRange:
+		return "ColorRange"
+	case o.ColorPrimaries != n.ColorPrimaries:
+		return "ColorPrimaries"
+	case o.TransferCharacteristics != n.TransferCharacteristics:
+		return "TransferCharacteristics"
+	case o.ColorMatrix != n.ColorMatrix:
+		return "ColorMatrix"
+	case !equalMaps(o.Extra, n.Extra):
+		return "Extra"
+	}
+
+	return ""
+}
+
+// Encode encodes image and writes the encoded payload to the writer.
+// The image must be *image.RGBA, *image.NRGBA, *image.YCbCr, *image.Gray or *YCbCr, other types are rejected.
+// Alpha is ignored, image.NRGBA pixels are converted from their stored colors.
+func (e *Encoder) Encode(im image.Image) (err error) {
+	b, info, err := e.EncodeFrameInfo(im)
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodeWithQP is like Encode but forces quantizer qp for the frame, overriding rate control for that frame only.
+// Range is 0-51, 0 is lossless. With BitDepth 10 the range extends to 63.
+// With RateControlCQP x264 clips it to the range spanned by the I, P and B frame quantizers.
+func (e *Encoder) EncodeWithQP(im image.Image, qp int) (err error) {
+	if max := 51 + 6*(e.depth-8); qp < 0 || qp > max {
+		err = errorf(ErrInvalidInput, "x264: invalid qp %d, must be between 0 and %d", qp, max)
+		return
+	}
+
+	e.qpplus1 = int32(qp + 1)
+	defer func() {
+		e.qpplus1 = 0
+	}()
+
+	err = e.Encode(im)
+	return
+}
+
+// EncodeWithQuantOffsets is like Encode but applies per macroblock quantizer offsets to the frame,
+// negative offsets raise quality of a region and positive lower it. Offsets are in raster order,
+// one per 16x16 macroblock, ceil(Width/16)*ceil(Height/16) values, with the rows rounded up to even if Interlaced. x264 applies them through AQ, which MB-tree keeps
+// on, they are rejected if AQ is off, i.e. with AQModeNone and NoMBTree or with RateControlCQP.
+func (e *Encoder) EncodeWithQuantOffsets(im image.Image, offsets []float32) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(e.e, &param)
+	if param.Rc.IAqMode == x264c.AqNone {
+		err = errorf(ErrInvalidInput, "x264: quant offsets have no effect with AQ off")
+		return
+	}
+
+	// x264 codes interlaced frames as field pairs and rounds the macroblock rows up to even
+	cols, rows := (int(param.IWidth)+15)/16, (int(param.IHeight)+15)/16
+	if param.BInterlaced != 0 || param.BFakeInterlaced != 0 {
+		rows = (rows + 1) &^ 1
+	}
+
+	if n := cols * rows; len(offsets) != n {
+		err = errorf(ErrInvalidInput, "x264: invalid quant offsets length %d, want %d (%dx%d macroblocks)", len(offsets), n, cols, rows)
+		return
+	}
+
+	e.quantOffsets = offsets
+	defer func() {
+		e.quantOffsets = nil
+	}()
+
+	err = e.Encode(im)
+	return
+}
+
+// EncodeBatch encodes images in order and writes the encoded payloads to the writer.
+// It returns the number of bytes written, delayed frames are not flushed.
+func (e *Encoder) EncodeBatch(imgs []image.Image) (n int64, err error) {
+	for _, im := range imgs {
+		var b []byte
+		var info FrameInfo
+		b, info, err = e.EncodeFrameInfo(im)
+		if err != nil {
+			return
+		}
+
+		err = e.writeFrame(b, info)
+		if err != nil {
+			return
+		}
+
+		n += int64(len(b))
+	}
+
+	return
+}
+
+// EncodeWithPTS is like Encode but uses pts as the presentation timestamp of the frame, in Timebase units.
+// Frames encoded with Encode afterwards continue from pts+1.
+//
+// With CFR, pts places the frame on the FrameRate cadence instead. A frame behind the cadence is dropped,
+// a gap is filled by repeating the previous picture, including one encoded from raw planes.
+func (e *Encoder) EncodeWithPTS(im image.Image, pts int64) (err error) {
+	if e.opts.CFR {
+		err = e.encodeCFR(im, pts)
+		return
+	}
+
+	e.pts = pts
+	err = e.Encode(im)
+	return
+}
+
+// encodeCFR encodes im at the frame number of pts on the FrameRate cadence, counted from the first call.
+func (e *Encoder) encodeCFR(im image.Image, pts int64) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	if !e.cfrStarted {
+		e.cfrStarted = true
+		e.cfrStart, e.cfrBase = pts, e.pts
+	}
+
+	tb := int64(e.opts.Timebase)
+	if tb == 0 {
+		tb = int64(e.opts.FrameRate)
+	}
+
+	// nearest frame number, rounding half up
+	d := pts - e.cfrStart
+	if d < 0 {
+		e.stats.FramesDropped++
+		return
+	}
+
+	n := e.cfrBase + (2*d*int64(e.opts.FrameRate)+tb)/(2*tb)
+	if n < e.pts {
+		e.stats.FramesDropped++
+		return
+	}
+
+	for e.pts < n {
+		b, info, er := e.repeatPicture()
+		if er != nil {
+			err = er
+			return
+		}
+
+		err = e.writeFrame(b, info)
+		if err != nil {
+			return
+		}
+
+		e.stats.FramesRepeated++
+	}
+
+	err = e.Encode(im)
+	return
+}
+
+// repeatPicture encodes the last picture again, the converted image with its alpha or the raw planes held in cplanes.
+func (e *Encoder) repeatPicture() (b []byte, info FrameInfo, err error) {
+	if !e.rawLast {
+		return e.encodeImage()
+	}
+
+	n := 3
+	switch e.csp {
+	case x264c.CspNv12:
+		n = 2
+	case x264c.CspI400:
+		n = 1
+	}
+
+	strides := make([]int, n)
+	for i := range strides {
+		strides[i], _ = e.planeSize(i, e.width, e.height)
+	}
+
+	return e.encodePicture(e.cplanes[:n], strides)
+}
+
+// EncodeContext is like Encode but returns the context error without encoding if ctx is done.
+func (e *Encoder) EncodeContext(ctx context.Context, im image.Image) (err error) {
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	return e.Encode(im)
+}
+
+// EncodeChannel encodes images received from frames until the channel is closed and flushes delayed frames,
+// i.e. run on its own goroutine by a pipeline consumer. It returns the first error or the context error when ctx
+// is done, frames is not drained then and producers should stop on the same ctx.
+func (e *Encoder) EncodeChannel(ctx context.Context, frames <-chan image.Image) (err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case im, ok := <-frames:
+			if !ok {
+				err = e.FlushContext(ctx)
+				return
+			}
+
+			err = e.EncodeContext(ctx, im)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// EncodeFrame encodes image and returns the encoded payload instead of writing it to the writer.
+// The returned payload is nil if the encoder buffered the frame, an output frame is never empty.
+func (e *Encoder) EncodeFrame(im image.Image) (b []byte, err error) {
+	b, _, err = e.EncodeFrameInfo(im)
+	return
+}
+
+// EncodeFrameInfo is like EncodeFrame but also returns the metadata of the encoded frame, FrameInfo.Buffered is set
+// if no frame was output. Because of frame reordering the metadata may describe an earlier image.
+// If im is nil, a delayed frame is flushed.
+func (e *Encoder) EncodeFrameInfo(im image.Image) (b []byte, info FrameInfo, err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	if im == nil {
+		return e.encode(nil)
+	}
+
+	resize := false
+	if size := im.Bounds().Size(); size != image.Pt(e.opts.Width, e.opts.Height) {
+		if !e.opts.Resize {
+			err = errorf(ErrInvalidInput, "x264: invalid image size %dx%d, want %dx%d", size.X, size.Y, e.opts.Width, e.opts.Height)
+			return
+		}
+
+		resize = true
+	}
+
+	err = e.fromImage(im, resize)
+	if err != nil {
+		return
+	}
+
+	if e.alpha != nil {
+		e.fromAlpha(im)
+	}
+
+	return e.encodeImage()
+}
+
+// fromImage converts im into e.img with the conversion path of its concrete type, scaling it if resize is set.
+// Other image types are rejected rather than converted through color.Color.
+func (e *Encoder) fromImage(im image.Image, resize bool) error {
+	switch im.(type) {
+	case *image.RGBA, *image.NRGBA, *image.YCbCr, *YCbCr, *image.Gray:
+	default:
+		return errorf(ErrInvalidInput, "x264: unsupported image type %T, want *image.RGBA, *image.NRGBA, *image.YCbCr or *image.Gray", im)
+	}
+
+	if im.Bounds().Empty() {
+		return errorf(ErrInvalidInput, "x264: invalid empty image %v", im.Bounds())
+	}
+
+	if v, ok := im.(*YCbCr); ok {
+		im = v.YCbCr
+	}
+
+	bt709 := e.opts.ColorMatrix == "bt709"
+
+	if resize {
+		if bt709 {
+			e.img.resize(im, e.opts.Width, e.opts.Height, RGBToYCbCrBT709)
+		} else {
+			e.img.resize(im, e.opts.Width, e.opts.Height, RGBToYCbCrBT601)
+		}
+
+		e.grayChroma = false
+		return nil
+	}
+
+	switch src := im.(type) {
+	case *image.Gray:
+		e.img.fromGray(src)
+
+		// neutral chroma is kept while gray images are encoded
+		if !e.grayChroma && e.csp != x264c.CspI400 {
+			e.img.fillChroma(128)
+			e.grayChroma = true
+		}
+
+		return nil
+	case *image.YCbCr:
+		switch {
+		case e.img.canCopy(src, e.opts.Width, e.opts.Height):
+			e.img.fromYCbCr(src)
+		case bt709:
+			e.img.ToYCbCrBT709(src)
+		default:
+			e.img.ToYCbCrDraw(src)
+		}
+	case *image.NRGBA:
+		if bt709 {
+			e.img.fromNRGBA(src, RGBToYCbCrBT709)
+		} else {
+			e.img.fromNRGBA(src, RGBToYCbCrBT601)
+		}
+	case *image.RGBA:
+		switch {
+		case bt709:
+			e.img.ToYCbCrBT709(src)
+		case e.img.SubsampleRatio == image.YCbCrSubsampleRatio420 && src.Bounds().Size() == e.img.Rect.Size():
+			e.img.ToYCbCr(src)
+		default:
+			b := src.Rect
+			e.img.fromRGB(src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, 4, b.Dx(), b.Dy(), RGBToYCbCrBT601)
+		}
+	}
+
+	e.grayChroma = false
+	return nil
+}
+
+// fromAlpha copies the alpha of im into e.alphaImg, images without alpha are opaque.
+func (e *Encoder) fromAlpha(im image.Image) {
+	b := im.Bounds()
+	if e.alphaImg == nil || e.alphaImg.Rect.Size() != b.Size() {
+		e.alphaImg = image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	}
+
+	var pix []byte
+	var stride int
+
+	switch src := im.(type) {
+	case *image.RGBA:
+		pix, stride = src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride
+	case *image.NRGBA:
+		pix, stride = src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride
+	default:
+		for i := range e.alphaImg.Pix {
+			e.alphaImg.Pix[i] = 255
+		}
+		return
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		dst := e.alphaImg.Pix[y*e.alphaImg.Stride : y*e.alphaImg.Stride+b.Dx()]
+		for x := range dst {
+			dst[x] = pix[y*stride+4*x+3]
+		}
+	}
+}
+
+// opaqueAlpha sets e.alphaImg to an opaque plane of the encoder size, for input converted without alpha.
+func (e *Encoder) opaqueAlpha() {
+	w, h := e.opts.Width, e.opts.Height
+	if e.alphaImg == nil || e.alphaImg.Rect.Size() != image.Pt(w, h) {
+		e.alphaImg = image.NewGray(image.Rect(0, 0, w, h))
+	}
+
+	for i := range e.alphaImg.Pix {
+		e.alphaImg.Pix[i] = 255
+	}
+}
+
+// encodeAlpha encodes e.alphaImg to the alpha stream with the PTS and forced type of the next picture.
+func (e *Encoder) encodeAlpha() error {
+	e.alpha.pts = e.pts
+	e.alpha.nextType = e.nextType
+	if _, ok := e.keyframes[e.pts]; ok {
+		e.alpha.nextType = FrameIDR
+	}
+
+	return e.alpha.Encode(e.alphaImg)
+}
+
+// encodeImage encodes the converted frame held in e.img, and its alpha with an alpha stream.
+func (e *Encoder) encodeImage() (b []byte, info FrameInfo, err error) {
+	e.rawLast = false
+
+	if e.alpha != nil {
+		err = e.encodeAlpha()
+		if err != nil {
+			return
+		}
+	}
+
+	if e.width != e.opts.Width || e.height != e.opts.Height {
+		e.img.padEdges(e.opts.Width, e.opts.Height)
+	}
+
+	planes := [][]byte{e.img.Y, e.img.Cb, e.img.Cr}
+	switch e.csp {
+	case x264c.CspNv12:
+		e.img.interleaveCbCr(e.cbcr)
+		planes = [][]byte{e.img.Y, e.cbcr}
+	case x264c.CspI400:
+		planes = planes[:1]
+	}
+
+	strides := make([]int, len(planes))
+	for i := range planes {
+		strides[i], _ = e.planeSize(i, e.width, e.height)
+
+		if e.depth > 8 {
+			expandDepth(cslice(e.cplanes[i], e.cplanesLen[i]), planes[i], e.depth)
+			continue
+		}
+
+		n := len(planes[i])
+		if n > e.cplanesLen[i] {
+			n = e.cplanesLen[i]
+		}
+
+		C.memcpy(e.cplanes[i], unsafe.Pointer(&planes[i][0]), C.size_t(n))
+	}
+
+	return e.encodePicture(e.cplanes[:len(planes)], strides)
+}
+
+// EncodeNALs encodes image and returns the NAL units of the encoded frame instead of writing them to the writer.
+// The returned slice is empty if the encoder buffered the frame. If im is nil, a delayed frame is flushed.
+func (e *Encoder) EncodeNALs(im image.Image) (nals []NAL, err error) {
+	b, _, err := e.EncodeFrameInfo(im)
+	if err != nil {
+		return
+	}
+
+	nals = e.splitNALs(b)
+	return
+}
+
+// splitNALs splits payload b returned by the last x264 call into NAL units.
+func (e *Encoder) splitNALs(b []byte) []NAL {
+	units := e.nalUnits()
+	if len(b) == 0 || len(units) == 0 {
+		return nil
+	}
+
+	nals := make([]NAL, 0, len(units))
+	base := uintptr(units[0].PPayload)
+
+	for i := range units {
+		nal := &units[i]
+
+		off := int(uintptr(nal.PPayload) - base)
+		nals = append(nals, NAL{
+			Type:     nal.IType,
+			Priority: nal.IRefIdc,
+			Payload:  b[off+e.nalPrefix(nal) : off+int(nal.IPayload)],
+		})
+	}
+
+	return nals
+}
+
+// EncodeNV12 encodes raw NV12 image, with full Y plane followed by interleaved CbCr plane.
+// The encoder must be configured with ColorSpaceNV12.
+func (e *Encoder) EncodeNV12(y, cbcr []byte) (err error) {
+	if e.csp != x264c.CspNv12 {
+		err = errorf(ErrInvalidInput, "x264: encoder is not configured for NV12")
+		return
+	}
+
+	planes := [][]byte{y, cbcr}
+	strides := []int{e.opts.Width, 2 * ((e.opts.Width + 1) / 2)}
+
+	err = e.checkPlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	b, info, err := e.encodePlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodeNV21 encodes raw NV21 image, as produced by Android cameras, with full Y plane followed by interleaved CrCb plane.
+// The planes are converted, the encoder must be configured with a 4:2:0 color space or ColorSpaceI400.
+func (e *Encoder) EncodeNV21(y, vu []byte) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	if e.img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		err = errorf(ErrInvalidInput, "x264: NV21 input requires a 4:2:0 color space")
+		return
+	}
+
+	w, h := e.opts.Width, e.opts.Height
+	cw, ch := (w+1)/2, (h+1)/2
+
+	if len(y) < w*h || len(vu) < 2*cw*ch {
+		err = errorf(ErrInvalidInput, "x264: invalid NV21 planes, size=%d,%d, want %d,%d", len(y), len(vu), w*h, 2*cw*ch)
+		return
+	}
+
+	e.img.fromNV21(y, vu, w, 2*cw, w, h)
+	e.grayChroma = false
+
+	if e.alpha != nil {
+		e.opaqueAlpha()
+	}
+
+	b, info, err := e.encodeImage()
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodeRGB24 encodes packed 8-bit RGB image with the given stride in bytes.
+// Pixels are converted with BT.709 coefficients if ColorMatrix is bt709, otherwise BT.601, both studio range.
+func (e *Encoder) EncodeRGB24(pix []byte, stride int) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	w, h := e.opts.Width, e.opts.Height
+
+	if stride < 3*w || len(pix) < stride*(h-1)+3*w {
+		err = errorf(ErrInvalidInput, "x264: invalid RGB24 image, size=%d, stride=%d, want %dx%d", len(pix), stride, w, h)
+		return
+	}
+
+	convert := RGBToYCbCrBT601
+	if e.opts.ColorMatrix == "bt709" {
+		convert = RGBToYCbCrBT709
+	}
+
+	e.img.fromRGB(pix, stride, 3, w, h, convert)
+	e.grayChroma = false
+
+	if e.alpha != nil {
+		e.opaqueAlpha()
+	}
+
+	b, info, err := e.encodeImage()
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodeRaw encodes raw planar image, i.e. YUV 4:2:0 for ColorSpaceI420 or YUV 4:2:2 for ColorSpaceI422.
+// Chroma planes share strideC, they are ignored for ColorSpaceI400. Strides are in bytes, with BitDepth 10 samples are 16-bit little-endian.
+//
+// Where supported (Go 1.21+) the planes are passed to x264 without copying, otherwise they are copied to C memory.
+// x264 reads the planes only during the call, they must not be modified until EncodeRaw returns and can be reused afterwards.
+func (e *Encoder) EncodeRaw(y, cb, cr []byte, strideY, strideC int) (err error) {
+	if e.csp == x264c.CspNv12 {
+		err = errorf(ErrInvalidInput, "x264: encoder is configured for NV12, use EncodeNV12")
+		return
+	}
+
+	return e.EncodeRawStrides(y, cb, cr, strideY, strideC, strideC)
+}
+
+// EncodeRawStrides is like EncodeRaw with a stride per plane, i.e. for padded or aligned buffers of capture devices.
+// Cb and Cr may be slices of one buffer. For ColorSpaceNV12 cb holds the interleaved CbCr plane and cr is ignored.
+//
+// A plane of w bytes by h rows needs a stride of at least w and at least stride*(h-1)+w bytes, the last row need
+// not be padded. Luma is Width by Height samples, 4:2:0 chroma (Width+1)/2 by (Height+1)/2, 4:2:2 chroma
+// (Width+1)/2 by Height and NV12 CbCr 2*((Width+1)/2) by (Height+1)/2 bytes, samples are 2 bytes with BitDepth 10.
+func (e *Encoder) EncodeRawStrides(y, cb, cr []byte, strideY, strideCb, strideCr int) (err error) {
+	planes := [][]byte{y, cb, cr}
+	strides := []int{strideY, strideCb, strideCr}
+
+	switch e.csp {
+	case x264c.CspNv12:
+		planes, strides = planes[:2], strides[:2]
+	case x264c.CspI400:
+		planes, strides = planes[:1], strides[:1]
+	}
+
+	err = e.checkPlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	b, info, err := e.encodePlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodePlanes encodes the pre-converted planes of in with its PTS. Plane sizes and strides are checked against
+// the configured dimensions and color space. CFR conversion does not apply, frames encoded with Encode afterwards
+// continue from PTS+1. Where supported the planes are read in place as with EncodeRaw.
+func (e *Encoder) EncodePlanes(in PlaneInput) (err error) {
+	planes := [][]byte{in.Y, in.Cb, in.Cr}
+	strides := []int{in.StrideY, in.StrideC, in.StrideC}
+
+	switch e.csp {
+	case x264c.CspNv12:
+		planes, strides = planes[:2], strides[:2]
+	case x264c.CspI400:
+		planes, strides = planes[:1], strides[:1]
+	}
+
+	err = e.checkPlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	e.pts = in.PTS
+
+	b, info, err := e.encodePlanes(planes, strides)
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// EncodeRawPointer is like EncodeRaw but takes planes as pointers to memory outside the Go heap, i.e. mmap'd files
+// or C buffers, with their sizes and strides in bytes. Planes are passed in x264 order: Y, Cb, Cr for planar color spaces,
+// Y and CbCr for ColorSpaceNV12, Y only for ColorSpaceI400. The planes are read in place without copying,
+// except for padded odd sizes.
+//
+// The memory must not point into the Go heap, and it must stay valid and unmodified until EncodeRawPointer returns.
+func (e *Encoder) EncodeRawPointer(planes []unsafe.Pointer, sizes, strides []int) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	n := 3
+	switch e.csp {
+	case x264c.CspNv12:
+		n = 2
+	case x264c.CspI400:
+		n = 1
+	}
+
+	if len(planes) != n || len(sizes) != n || len(strides) != n {
+		err = errorf(ErrInvalidInput, "x264: invalid number of planes %d, want %d", len(planes), n)
+		return
+	}
+
+	bufs := make([][]byte, n)
+	for i := range planes {
+		if planes[i] == nil || sizes[i] < 0 {
+			err = errorf(ErrInvalidInput, "x264: invalid plane %d pointer or size %d", i, sizes[i])
+			return
+		}
+
+		bufs[i] = cslice(planes[i], sizes[i])
+	}
+
+	err = e.checkPlanes(bufs, strides)
+	if err != nil {
+		return
+	}
+
+	var b []byte
+	var info FrameInfo
+	if e.width != e.opts.Width || e.height != e.opts.Height || e.opts.CFR {
+		b, info, err = e.encodePlanes(bufs, strides)
+	} else {
+		b, info, err = e.encodePicture(planes, strides)
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = e.writeFrame(b, info)
+	return
+}
+
+// planeSize returns dimensions of plane n in bytes of width x height picture for the configured color space and bit depth.
+func (e *Encoder) planeSize(n, width, height int) (w, h int) {
+	w, h = width, height
+
+	if n > 0 {
+		switch e.csp {
+		case x264c.CspI420:
+			w, h = (w+1)/2, (h+1)/2
+		case x264c.CspI422:
+			w = (w + 1) / 2
+		case x264c.CspNv12:
+			w, h = 2*((w+1)/2), (h+1)/2
+		}
+	}
+
+	if e.depth > 8 {
+		w *= 2
+	}
+
+	return
+}
+
+// checkPlanes validates plane sizes and strides against the configured dimensions.
+func (e *Encoder) checkPlanes(planes [][]byte, strides []int) error {
+	for i := range planes {
+		w, h := e.planeSize(i, e.opts.Width, e.opts.Height)
+
+		if strides[i] < w {
+			return errorf(ErrInvalidInput, "x264: invalid plane %d stride %d, want at least %d", i, strides[i], w)
+		}
+
+		if size := strides[i]*(h-1) + w; len(planes[i]) < size {
+			return errorf(ErrInvalidInput, "x264: invalid plane %d size %d, want at least %d", i, len(planes[i]), size)
+		}
+	}
+
+	return nil
+}
+
+// encodePlanes encodes picture from planes with the given strides.
+// Planes of padded odd sizes are copied with padding into C buffers, with CFR all planes are copied to be repeated.
+func (e *Encoder) encodePlanes(planes [][]byte, strides []int) (b []byte, info FrameInfo, err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	e.rawLast = true
+
+	if e.width != e.opts.Width || e.height != e.opts.Height || e.opts.CFR {
+		padded := make([]int, len(planes))
+		for i := range planes {
+			w, h := e.planeSize(i, e.opts.Width, e.opts.Height)
+			dw, dh := e.planeSize(i, e.width, e.height)
+
+			// luma is the only padded plane, one sample per pixel
+			bpp := 1
+			if e.depth > 8 {
+				bpp = 2
+			}
+
+			padPlane(cslice(e.cplanes[i], e.cplanesLen[i]), dw, dh, planes[i], strides[i], w, h, bpp)
+			padded[i] = dw
+		}
+
+		return e.encodePicture(e.cplanes[:len(planes)], padded)
+	}
+
+	var pin pinner
+	defer pin.release()
+
+	ptrs := make([]unsafe.Pointer, len(planes))
+	for i := range planes {
+		ptrs[i] = pin.ptr(planes[i])
+	}
+
+	return e.encodePicture(ptrs, strides)
+}
+
+// encodePicture encodes picture from plane pointers with the given strides.
+func (e *Encoder) encodePicture(planes []unsafe.Pointer, strides []int) (b []byte, info FrameInfo, err error) {
 	picIn := e.picIn
-	x264c.PictureClean(&picIn)
-	x264c.EncoderClose(e.e)
+
+	picIn.Img.ICsp = e.csp
+	if e.depth > 8 {
+		picIn.Img.ICsp |= x264c.CspHighDepth
+	}
+
+	picIn.Img.IPlane = int32(len(planes))
+	for i := range planes {
+		picIn.Img.IStride[i] = int32(strides[i])
+		picIn.Img.Plane[i] = planes[i]
+	}
+
+	if e.nextType != FrameAuto {
+		picIn.IType = int32(e.nextType)
+		e.nextType = FrameAuto
+	}
+
+	if e.qpplus1 > 0 {
+		picIn.IQpplus1 = e.qpplus1
+	}
+
+	if e.sei != nil {
+		attachSEI(&picIn, e.sei)
+		e.sei = nil
+	}
+
+	if e.quantOffsets != nil {
+		attachQuantOffsets(&picIn, e.quantOffsets)
+	}
+
+	if _, ok := e.keyframes[e.pts]; ok {
+		picIn.IType = int32(FrameIDR)
+		delete(e.keyframes, e.pts)
+	}
+
+	picIn.IPts = e.pts
+	e.pts++
+
+	return e.encode(&picIn)
+}
+
+// encode encodes picture, or a delayed frame if picIn is nil.
+func (e *Encoder) encode(picIn *x264c.Picture) (b []byte, info FrameInfo, err error) {
+	picOut := e.picOut
+
+	var start time.Time
+	if e.opts.OnEncodeTime != nil {
+		start = time.Now()
+	}
+
+	ret := x264c.EncoderEncode(e.e, e.nals, &e.nnals, picIn, picOut)
+
+	if e.opts.OnEncodeTime != nil {
+		e.opts.OnEncodeTime(time.Since(start))
+	}
+
+	switch resultOf(ret) {
+	case resultError:
+		err = errorf(ErrEncode, "x264: cannot encode picture")
+	case resultBuffered:
+		e.stats.last = 0
+		e.stats.lastKeyframe = false
+		info.Buffered = true
+	case resultOutput:
+		e.stats.last = int(ret)
+		e.stats.lastKeyframe = picOut.BKeyframe != 0
+
+		b = C.GoBytes(e.nals[0].PPayload, C.int(ret))
+
+		info.Type = FrameType(picOut.IType)
+		info.PTS = picOut.IPts
+		info.DTS = picOut.IDts
+		info.QP = int(picOut.IQpplus1) - 1
+		info.Keyframe = picOut.BKeyframe != 0
+
+		e.stats.add(info, ret, picOut)
+		e.telemetry(info, ret)
+	}
+
+	return
+}
+
+// ForceKeyframe forces the next encoded frame to be an IDR frame.
+// The request applies to the next Encode call only, later frames follow the normal GOP decisions.
+//
+// With intra refresh enabled x264 does not emit periodic IDR frames, the forced IDR is still coded
+// as a full IDR frame and restarts the refresh cycle.
+func (e *Encoder) ForceKeyframe() {
+	e.nextType = FrameIDR
+}
+
+// ScheduleKeyframes forces IDR frames for the pictures encoded with the given frame numbers, the PTS values
+// assigned by Encode, overriding SetNextFrameType for them. Frame numbers add to earlier scheduled ones,
+// numbers already passed are never reached. Reset clears the schedule.
+func (e *Encoder) ScheduleKeyframes(frameNumbers []int64) {
+	if e.keyframes == nil {
+		e.keyframes = make(map[int64]struct{}, len(frameNumbers))
+	}
+
+	for _, n := range frameNumbers {
+		e.keyframes[n] = struct{}{}
+	}
+}
+
+// InvalidateReference marks the frame with the given PTS and all later frames as lost, later frames only reference
+// frames before it, or an IDR frame is forced if none is left. Use it when a client reports a decoding error.
+// A large DPBSize keeps older frames available. x264 has no long-term reference control beyond this.
+// B-frames and intra refresh must be disabled.
+func (e *Encoder) InvalidateReference(pts int64) (err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	if e.param.IBframe != 0 || e.param.BIntraRefresh != 0 {
+		err = errorf(ErrInvalidInput, "x264: cannot invalidate reference with B-frames or intra refresh enabled")
+		return
+	}
+
+	ret := x264c.EncoderInvalidateReference(e.e, int(pts))
+	if ret < 0 {
+		err = errorf(ErrEncode, "x264: cannot invalidate reference")
+		return
+	}
+
+	return
+}
+
+// SetNextFrameType forces the type of the next encoded frame, FrameAuto cancels a pending request.
+// Like ForceKeyframe it applies to the next Encode call only. B-frame types require BFrames enabled.
+// x264 codes a forced I-frame as IDR once KeyintMin frames passed since the last keyframe,
+// and may change a forced B-frame it cannot honor, i.e. at the end of a GOP.
+func (e *Encoder) SetNextFrameType(t FrameType) (err error) {
+	switch t {
+	case FrameAuto, FrameIDR, FrameI, FrameP:
+	case FrameBref, FrameB:
+		if e.param.IBframe == 0 {
+			err = errorf(ErrInvalidInput, "x264: invalid frame type %d, B-frames are disabled", t)
+			return
+		}
+	default:
+		err = errorf(ErrInvalidInput, "x264: invalid frame type %d", t)
+		return
+	}
+
+	e.nextType = t
+	return
+}
+
+// SetSEIUserData attaches an unregistered user data SEI with the given UUID and data to the next encoded image.
+// x264 emits the SEI ahead of the slice NAL units of that frame, the data is sent once.
+func (e *Encoder) SetSEIUserData(uuid [16]byte, data []byte) {
+	e.sei = make([]byte, 0, len(uuid)+len(data))
+	e.sei = append(e.sei, uuid[:]...)
+	e.sei = append(e.sei, data...)
+}
+
+// attachSEI attaches user data unregistered SEI payload to picIn.
+// The payload is copied to C memory that x264 frees after writing the SEI, possibly in a later call.
+func attachSEI(picIn *x264c.Picture, payload []byte) {
+	p := (*x264c.SeiPayload)(C.malloc(C.size_t(unsafe.Sizeof(x264c.SeiPayload{}))))
+	p.PayloadSize = int32(len(payload))
+	p.PayloadType = seiUserDataUnregistered
+	p.Payload = (*uint8)(C.CBytes(payload))
+
+	picIn.ExtraSei.NumPayloads = 1
+	picIn.ExtraSei.Payloads = p
+	picIn.ExtraSei.SeiFree = (*[0]byte)(C.free)
+}
+
+// attachQuantOffsets attaches macroblock quantizer offsets to picIn.
+// The offsets are copied to C memory that x264 frees once the frame is analysed, possibly in a later call.
+func attachQuantOffsets(picIn *x264c.Picture, offsets []float32) {
+	size := len(offsets) * int(unsafe.Sizeof(offsets[0]))
+	p := C.malloc(C.size_t(size))
+	copy(cslice(p, size), (*[1 << 28]byte)(unsafe.Pointer(&offsets[0]))[:size:size])
+
+	picIn.Prop.QuantOffsets = (*float32)(p)
+	picIn.Prop.QuantOffsetsFree = (*[0]byte)(C.free)
+}
+
+// DelayedFrames returns the number of frames x264 holds that Flush would still emit, zero once closed.
+func (e *Encoder) DelayedFrames() int {
+	if e.e == nil {
+		return 0
+	}
+
+	return int(x264c.EncoderDelayedFrames(e.e))
+}
+
+// Flush flushes encoder.
+func (e *Encoder) Flush() (err error) {
+	return e.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but stops and returns the context error when ctx is done.
+// The context is checked before each delayed frame, remaining frames can be flushed with a later call.
+func (e *Encoder) FlushContext(ctx context.Context) (err error) {
+	_, _, err = e.drain(ctx)
+	return
+}
+
+// Drain is like Flush but also returns the number of delayed frames emitted and bytes written.
+func (e *Encoder) Drain() (frames int, n int64, err error) {
+	return e.drain(context.Background())
+}
+
+// drain encodes and writes delayed frames until none are left or ctx is done.
+func (e *Encoder) drain(ctx context.Context) (frames int, n int64, err error) {
+	if e.e == nil {
+		err = ErrClosed
+		return
+	}
+
+	for x264c.EncoderDelayedFrames(e.e) > 0 {
+		err = ctx.Err()
+		if err != nil {
+			return
+		}
+
+		var b []byte
+		var info FrameInfo
+		b, info, err = e.encode(nil)
+		if err != nil {
+			return
+		}
+
+		err = e.writeFrame(b, info)
+		if err != nil {
+			return
+		}
+
+		if len(b) > 0 {
+			frames++
+			n += int64(len(b))
+		}
+	}
+
+	if e.alpha != nil {
+		_, _, err = e.alpha.drain(ctx)
+	}
+
+	return
+}
+
+// AddWriter adds w as an additional writer receiving the encoded payloads from the next frame on.
+// SPS and PPS are repeated with every keyframe, use ForceKeyframe for a decodable start.
+// A failing added writer is dropped and its error returned, the other writers keep receiving the stream.
+func (e *Encoder) AddWriter(w io.Writer) {
+	e.writers = append(e.writers, w)
+}
+
+// writeFrame passes encoded frame b to OnKeyframe and OnFrame and writes it, nothing is done for an empty b.
+func (e *Encoder) writeFrame(b []byte, info FrameInfo) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if info.Keyframe && e.opts.OnKeyframe != nil {
+		e.opts.OnKeyframe(info.PTS)
+	}
+
+	if e.opts.OnFrame != nil {
+		e.opts.OnFrame(info, b)
+	}
+
+	// the frame is counted with its bytes, whether or not the added writers fail
+	written := e.written
+	err := e.write(b)
+	if e.written > written {
+		e.writtenFrames++
+	}
+
+	return err
+}
+
+// write writes encoded payload to the writer and the added writers.
+// Added writers that fail are dropped, the writer error takes precedence over theirs.
+func (e *Encoder) write(b []byte) error {
+	var err error
+	if e.w != nil {
+		err = writeFull(e.w, b)
+	}
+	if err == nil {
+		e.written += int64(len(b))
+	}
+	if len(e.writers) == 0 {
+		return err
+	}
+
+	var failed []string
+	writers := e.writers[:0]
+
+	for _, w := range e.writers {
+		if er := writeFull(w, b); er != nil {
+			failed = append(failed, fmt.Sprintf("%T: %v", w, er))
+			continue
+		}
+
+		writers = append(writers, w)
+	}
+
+	for i := len(writers); i < len(e.writers); i++ {
+		e.writers[i] = nil
+	}
+	e.writers = writers
+
+	if err == nil && len(failed) > 0 {
+		err = errorf(ErrWrite, "x264: error writing to added writers, dropped %s", strings.Join(failed, "; "))
+	}
+
+	return err
+}
+
+// writeFull writes payload b to w, retrying short writes.
+func writeFull(w io.Writer, b []byte) error {
+	size := len(b)
+
+	// a writer that accepts nothing without an error would loop forever
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return writeError(err)
+		}
+
+		if n <= 0 {
+			return errorf(ErrWrite, "x264: error writing payload, size=%d, n=%d", size, size-len(b))
+		}
+
+		b = b[n:]
+	}
+
 	return nil
 }
+
+// Close flushes delayed frames and closes encoder, the flush or write error is returned.
+// The encoder is released even if the writer fails or panics. Calling Close again has no effect.
+func (e *Encoder) Close() (err error) {
+	if e.closed {
+		return
+	}
+
+	e.closed = true
+
+	defer func() {
+		e.release()
+
+		if e.alpha != nil {
+			if er := e.alpha.Close(); err == nil {
+				err = er
+			}
+		}
+
+		if e.ring != nil {
+			e.ring.closeWrite(err)
+		}
+	}()
+
+	if e.e != nil {
+		err = e.Flush()
+	}
+
+	return
+}
+
+// release closes x264 and frees C memory held by the encoder.
+func (e *Encoder) release() {
+	if e.e != nil {
+		x264c.EncoderClose(e.e)
+		e.e = nil
+	}
+
+	e.freeLogger()
+	e.freeStatsFile()
+	if e.param != nil {
+		x264c.ParamCleanup(e.param)
+	}
+
+	picIn := e.picIn
+	x264c.PictureClean(&picIn)
+
+	for i := range e.cplanes {
+		C.free(e.cplanes[i])
+		e.cplanes[i] = nil
+	}
+}
+
+// freeStatsFile frees the stats file name, the encoder must not be reopened afterwards.
+func (e *Encoder) freeStatsFile() {
+	if e.statsFile != nil {
+		C.free(unsafe.Pointer(e.statsFile))
+		e.statsFile = nil
+	}
+}
+
+// cslice returns n bytes of C memory at p as a slice.
+func cslice(p unsafe.Pointer, n int) []byte {
+	return (*[1 << 30]byte)(p)[:n:n]
+}
+
+// expandDepth converts 8-bit samples from src into 16-bit little-endian samples of the given bit depth in dst.
+func expandDepth(dst, src []byte, depth int) {
+	shift := uint(depth - 8)
+
+	for i := 0; i < len(src) && 2*i+1 < len(dst); i++ {
+		v := uint16(src[i]) << shift
+		dst[2*i] = byte(v)
+		dst[2*i+1] = byte(v >> 8)
+	}
+}
+
+// padPlane copies w x h bytes plane src with the given stride into dst of dw x dh bytes,
+// the last bpp bytes sample of each row and the last row are repeated into the padding.
+func padPlane(dst []byte, dw, dh int, src []byte, stride, w, h, bpp int) {
+	for y := 0; y < h; y++ {
+		row := dst[y*dw : (y+1)*dw]
+		copy(row, src[y*stride:y*stride+w])
+
+		for x := w; x+bpp <= dw; x += bpp {
+			copy(row[x:x+bpp], row[w-bpp:w])
+		}
+	}
+
+	last := dst[(h-1)*dw : h*dw]
+	for y := h; y < dh; y++ {
+		copy(dst[y*dw:(y+1)*dw], last)
+	}
+}
+
+// allocImage sets the encoded dimensions for the option size and allocates the image for the color space.
+func (e *Encoder) allocImage() {
+	// H.264 cannot crop a single subsampled pixel, odd dimensions are padded to even by repeating the last column and row
+	e.width, e.height = e.opts.Width, e.opts.Height
+	switch e.csp {
+	case x264c.CspI420, x264c.CspNv12:
+		e.width += e.width % 2
+		e.height += e.height % 2
+	case x264c.CspI422:
+		e.width += e.width % 2
+	}
+
+	rect := image.Rect(0, 0, e.width, e.height)
+
+	e.cbcr = nil
+	switch e.csp {
+	case x264c.CspNv12:
+		e.img = NewYCbCr(rect)
+		e.cbcr = make([]byte, 2*len(e.img.Cb))
+	case x264c.CspI422:
+		e.img = &YCbCr{image.NewYCbCr(rect, image.YCbCrSubsampleRatio422)}
+	case x264c.CspI444:
+		e.img = &YCbCr{image.NewYCbCr(rect, image.YCbCrSubsampleRatio444)}
+	default:
+		e.img = NewYCbCr(rect)
+	}
+}
+
+// allocPlanes allocates C plane buffers for image input.
+func (e *Encoder) allocPlanes() {
+	n := 3
+	switch e.csp {
+	case x264c.CspNv12:
+		n = 2
+	case x264c.CspI400:
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		w, h := e.planeSize(i, e.width, e.height)
+		e.cplanesLen[i] = w * h
+		e.cplanes[i] = C.malloc(C.size_t(w * h))
+	}
+}
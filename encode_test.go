@@ -2,13 +2,26 @@ package x264
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/samespace/x264-go/x264c"
 )
 
 func TestEncode(t *testing.T) {
@@ -102,3 +115,5391 @@ func TestEncodeFlush(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestEncodeRateControl(t *testing.T) {
+	for _, opts := range []*Options{
+		{Width: 320, Height: 240, FrameRate: 25, RateControl: RateControlCRF, CRF: 28},
+		{Width: 320, Height: 240, FrameRate: 25, RateControl: RateControlABR, Bitrate: 500, VBVMaxRate: 500, VBVBufferSize: 1000},
+		{Width: 320, Height: 240, FrameRate: 25, RateControl: RateControlCQP, QP: 30},
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+
+		opts.LogLevel = LogError
+		enc, err := NewEncoder(buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		draw.Draw(img, img.Bounds(), image.Black, image.ZP, draw.Src)
+
+		for i := 0; i < 10; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		err = enc.Flush()
+		if err != nil {
+			t.Error(err)
+		}
+
+		enc.Close()
+
+		if buf.Len() == 0 {
+			t.Errorf("rate control %d: no output", opts.RateControl)
+		}
+	}
+
+	_, err := NewEncoder(ioutil.Discard, &Options{Width: 320, Height: 240, FrameRate: 25, RateControl: RateControlABR})
+	if err == nil {
+		t.Error("expected error for ABR without bitrate")
+	}
+}
+
+func TestEncodeForceKeyframe(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), image.Black, image.ZP, draw.Src)
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			enc.ForceKeyframe()
+		}
+
+		err = enc.Encode(img)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if enc.nextType != FrameAuto {
+		t.Error("keyframe request was not consumed")
+	}
+
+	// Annex B IDR slices start with 00 00 01 65.
+	idr := bytes.Count(buf.Bytes(), []byte{0, 0, 1, 0x65})
+	if idr != 2 {
+		t.Errorf("expected 2 IDR frames, got %d", idr)
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	headers := buf.Len()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), image.Black, image.ZP, draw.Src)
+
+	b, err := enc.EncodeFrame(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) == 0 {
+		t.Error("expected encoded payload with zerolatency tune")
+	}
+
+	if buf.Len() != headers {
+		t.Error("EncodeFrame must not write to the writer")
+	}
+}
+
+func TestEncodeFrameInfo(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), image.Black, image.ZP, draw.Src)
+
+	var infos []FrameInfo
+	for i := 0; i < 10; i++ {
+		b, info, err := enc.EncodeFrameInfo(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	for x264c.EncoderDelayedFrames(enc.e) > 0 {
+		b, info, err := enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	if len(infos) != 10 {
+		t.Fatalf("expected 10 frames, got %d", len(infos))
+	}
+
+	if infos[0].Type != FrameIDR || !infos[0].Keyframe || infos[0].PTS != 0 {
+		t.Errorf("unexpected first frame %+v", infos[0])
+	}
+
+	for _, info := range infos {
+		if info.QP < 0 || info.QP > 51 {
+			t.Errorf("invalid qp %d", info.QP)
+		}
+	}
+}
+
+func TestEncodeFrameInfoDTS(t *testing.T) {
+	opts := &Options{
+		Width:          320,
+		Height:         240,
+		FrameRate:      25,
+		Preset:         "veryfast",
+		Profile:        "high",
+		LogLevel:       LogError,
+		BFrames:        3,
+		BFrameAdaptive: BFrameAdaptiveNone,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	var infos []FrameInfo
+	for i := 0; i < 30; i++ {
+		for j := range img.Y {
+			img.Y[j] = uint8(i*7 + j%31)
+		}
+
+		b, info, err := enc.EncodeFrameInfo(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	for enc.DelayedFrames() > 0 {
+		b, info, err := enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b != nil {
+			infos = append(infos, info)
+		}
+	}
+
+	if len(infos) != 30 {
+		t.Fatalf("expected 30 frames, got %d", len(infos))
+	}
+
+	if infos[0].DTS >= 0 {
+		t.Errorf("expected negative initial DTS, got %d", infos[0].DTS)
+	}
+
+	pts := make(map[int64]bool)
+	reordered := false
+	for i, info := range infos {
+		if info.DTS > info.PTS {
+			t.Errorf("frame %d: DTS %d after PTS %d", i, info.DTS, info.PTS)
+		}
+
+		if i > 0 && info.DTS <= infos[i-1].DTS {
+			t.Errorf("frame %d: DTS %d not after %d", i, info.DTS, infos[i-1].DTS)
+		}
+
+		if i > 0 && info.PTS < infos[i-1].PTS {
+			reordered = true
+		}
+
+		pts[info.PTS] = true
+	}
+
+	if !reordered {
+		t.Error("expected B-frames to be reordered")
+	}
+
+	for i := int64(0); i < 30; i++ {
+		if !pts[i] {
+			t.Errorf("missing PTS %d", i)
+		}
+	}
+}
+
+func TestEncodeColorSpace(t *testing.T) {
+	for _, opts := range []*Options{
+		{Width: 320, Height: 240, FrameRate: 25, Preset: "veryfast", Profile: "high", ColorSpace: ColorSpaceNV12},
+		{Width: 320, Height: 240, FrameRate: 25, Preset: "veryfast", Profile: "high444", ColorSpace: ColorSpaceI444},
+		{Width: 320, Height: 240, FrameRate: 25, Preset: "veryfast", Profile: "high", ColorSpace: ColorSpaceI400},
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0))
+
+		opts.LogLevel = LogError
+		enc, err := NewEncoder(buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.ZP, draw.Src)
+
+		for i := 0; i < 5; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		err = enc.Flush()
+		if err != nil {
+			t.Error(err)
+		}
+
+		enc.Close()
+
+		if buf.Len() == 0 {
+			t.Errorf("color space %d: no output", opts.ColorSpace)
+		}
+	}
+}
+
+func TestEncodeNV12(t *testing.T) {
+	opts := &Options{
+		Width:      320,
+		Height:     240,
+		FrameRate:  25,
+		Tune:       "zerolatency",
+		Preset:     "veryfast",
+		Profile:    "baseline",
+		LogLevel:   LogError,
+		ColorSpace: ColorSpaceNV12,
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	y := make([]byte, opts.Width*opts.Height)
+	cbcr := make([]byte, opts.Width*opts.Height/2)
+	for i := range cbcr {
+		cbcr[i] = 128
+	}
+
+	err = enc.EncodeNV12(y, cbcr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.EncodeNV12(y, cbcr[:len(cbcr)-1])
+	if err == nil {
+		t.Error("expected error for short CbCr plane")
+	}
+}
+
+func TestEncodeRaw(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	// padded strides
+	strideY, strideC := opts.Width+32, opts.Width/2+16
+
+	y := make([]byte, strideY*opts.Height)
+	cb := make([]byte, strideC*opts.Height/2)
+	cr := make([]byte, strideC*opts.Height/2)
+
+	n := buf.Len()
+
+	err = enc.EncodeRaw(y, cb, cr, strideY, strideC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() == n {
+		t.Error("no output written")
+	}
+
+	err = enc.EncodeRaw(y, cb, cr, opts.Width-1, strideC)
+	if err == nil {
+		t.Error("expected error for short stride")
+	}
+
+	err = enc.EncodeRaw(y, cb[:strideC], cr, strideY, strideC)
+	if err == nil {
+		t.Error("expected error for short plane")
+	}
+}
+
+func TestEncodePlaneBuffers(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planes := enc.cplanes
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := 0; i < 3; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if enc.cplanes != planes {
+		t.Error("plane buffers were reallocated")
+	}
+
+	enc.Close()
+
+	for i := range enc.cplanes {
+		if enc.cplanes[i] != nil {
+			t.Errorf("plane %d was not freed", i)
+		}
+	}
+}
+
+func TestEncodeReconfig(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Tune:          "zerolatency",
+		Preset:        "veryfast",
+		Profile:       "baseline",
+		LogLevel:      LogError,
+		RateControl:   RateControlABR,
+		Bitrate:       1000,
+		VBVMaxRate:    1000,
+		VBVBufferSize: 1000,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Bitrate = 500
+	opts.VBVMaxRate = 500
+
+	err = enc.Reconfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+	if param.Rc.IBitrate != 500 || param.Rc.IVbvMaxBitrate != 500 {
+		t.Errorf("bitrate was not reconfigured, bitrate=%d, vbv=%d", param.Rc.IBitrate, param.Rc.IVbvMaxBitrate)
+	}
+
+	if o := enc.Options(); o.Bitrate != 500 || o.Width != 320 {
+		t.Errorf("unexpected options after reconfig %+v", o)
+	}
+
+	opts.Width = 640
+
+	err = enc.Reconfig(opts)
+	if err == nil {
+		t.Error("expected error when changing width")
+	}
+}
+
+func TestEncodeContext(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for i := 0; i < 5; i++ {
+		err = enc.EncodeContext(ctx, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+
+	err = enc.EncodeContext(ctx, img)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	if enc.pts != 5 {
+		t.Errorf("canceled frame was encoded, pts=%d", enc.pts)
+	}
+
+	err = enc.FlushContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	err = enc.FlushContext(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	n := buf.Len()
+
+	sps, pps, err := enc.Headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sps) == 0 || sps[0]&0x1f != 7 {
+		t.Errorf("invalid SPS % x", sps)
+	}
+
+	if len(pps) == 0 || pps[0]&0x1f != 8 {
+		t.Errorf("invalid PPS % x", pps)
+	}
+
+	if buf.Len() != n {
+		t.Error("Headers must not write to the writer")
+	}
+}
+
+func TestEncodeAVCC(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+		NALFormat: NALFormatAVCC,
+	}
+
+	enc, err := NewEncoder(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := 0; i < 3; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	types := make(map[byte]int)
+
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if len(b) < 4 {
+			t.Fatalf("truncated length prefix")
+		}
+
+		size := int(binary.BigEndian.Uint32(b))
+		if size == 0 || size > len(b)-4 {
+			t.Fatalf("invalid NAL size %d", size)
+		}
+
+		types[b[4]&0x1f]++
+		b = b[4+size:]
+	}
+
+	if types[7] == 0 || types[8] == 0 || types[5] != 1 || types[1] != 2 {
+		t.Errorf("unexpected NAL types %v", types)
+	}
+
+	sps, _, err := enc.Headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sps[0]&0x1f != 7 {
+		t.Errorf("invalid SPS % x", sps)
+	}
+}
+
+func TestEncodeNALs(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	nals, err := enc.EncodeNALs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make([]int32, 0)
+	for _, nal := range nals {
+		if len(nal.Payload) == 0 || int32(nal.Payload[0]&0x1f) != nal.Type {
+			t.Errorf("payload does not match NAL type %d", nal.Type)
+		}
+		types = append(types, nal.Type)
+	}
+
+	if len(types) < 3 || types[0] != NALSPS || types[1] != NALPPS || types[len(types)-1] != NALSliceIDR {
+		t.Errorf("unexpected NAL types %v", types)
+	}
+
+	nals, err = enc.EncodeNALs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nals) != 1 || nals[0].Type != NALSlice || nals[0].Priority == 0 {
+		t.Errorf("unexpected NALs %+v", nals)
+	}
+}
+
+func TestEncodeBitDepth(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high10",
+		LogLevel:  LogError,
+		BitDepth:  10,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if x264c.BitDepth == 8 {
+		if err == nil {
+			enc.Close()
+			t.Fatal("expected error for 10-bit encoding with 8-bit x264")
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpandDepth(t *testing.T) {
+	dst := make([]byte, 4)
+	expandDepth(dst, []byte{0x80, 0xff}, 10)
+
+	if !bytes.Equal(dst, []byte{0x00, 0x02, 0xfc, 0x03}) {
+		t.Errorf("unexpected samples % x", dst)
+	}
+}
+
+func TestEncodeStats(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "psnr,ssim",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogInfo,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{uint8(i * 20), 0, 0, 255}}, image.ZP, draw.Src)
+
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := enc.Stats()
+
+	if st.Frames != 10 || st.FramesI+st.FramesP+st.FramesB != st.Frames || st.FramesIDR < 1 {
+		t.Errorf("unexpected frame counts %+v", st)
+	}
+
+	if st.Bytes == 0 || st.Bitrate <= 0 || st.AvgQP <= 0 {
+		t.Errorf("unexpected size stats %+v", st)
+	}
+
+	if st.PSNR <= 0 || st.SSIM <= 0 || st.SSIM > 1 {
+		t.Errorf("unexpected quality stats %+v", st)
+	}
+}
+
+func TestEncodeWithPTS(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+		VFR:       true,
+		Timebase:  1000,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for _, pts := range []int64{0, 40, 150, 170} {
+		err = enc.EncodeWithPTS(img, pts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, info, err := enc.EncodeFrameInfo(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x264c.EncoderDelayedFrames(enc.e) > 0 {
+		b, info, err = enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if b == nil || info.PTS != 171 {
+		t.Errorf("PTS = %d, want 171", info.PTS)
+	}
+}
+
+func TestEncodeKeyint(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+		KeyintMax: 100,
+		KeyintMin: 5,
+		SceneCut:  -1,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.IKeyintMax != 100 || param.IKeyintMin != 5 || param.IScenecutThreshold != 0 {
+		t.Errorf("unexpected keyint params max=%d min=%d scenecut=%d", param.IKeyintMax, param.IKeyintMin, param.IScenecutThreshold)
+	}
+}
+
+func TestEncodeThreads(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Preset:        "veryfast",
+		Profile:       "baseline",
+		LogLevel:      LogError,
+		Threads:       2,
+		SlicedThreads: true,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.IThreads != 2 || param.BSlicedThreads != 1 {
+		t.Errorf("unexpected thread params threads=%d sliced=%d", param.IThreads, param.BSlicedThreads)
+	}
+
+	err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewBufferEncoder(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := buf.Len()
+	if n == 0 {
+		t.Error("expected headers in buffer")
+	}
+
+	err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc.Close()
+
+	if buf.Len() <= n || !bytes.Contains(buf.Bytes(), []byte{0, 0, 1, 0x65}) {
+		t.Errorf("expected IDR slice in buffer, got %d bytes", buf.Len())
+	}
+}
+
+func TestEncodeOddSize(t *testing.T) {
+	for _, size := range []image.Point{{641, 481}, {639, 479}, {333, 17}} {
+		for _, cs := range []int32{ColorSpaceI420, ColorSpaceNV12, ColorSpaceI422, ColorSpaceI444} {
+			opts := &Options{
+				Width:       size.X,
+				Height:      size.Y,
+				FrameRate:   25,
+				Tune:        "zerolatency",
+				Preset:      "ultrafast",
+				Profile:     "high444",
+				LogLevel:    LogError,
+				RateControl: RateControlCQP,
+				QP:          10,
+				ColorSpace:  cs,
+			}
+
+			enc, err := NewEncoder(ioutil.Discard, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					img.Set(x, y, color.RGBA{uint8(x * 255 / size.X), uint8(y * 255 / size.Y), uint8((x + y) % 256), 255})
+				}
+			}
+
+			b, _, err := enc.EncodeFrameInfo(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for b == nil && x264c.EncoderDelayedFrames(enc.e) > 0 {
+				b, _, err = enc.EncodeFrameInfo(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if b == nil {
+				t.Fatalf("%dx%d color space %d: no frame encoded", size.X, size.Y, cs)
+			}
+
+			if d := reconDiff(enc, img); d > 3 {
+				t.Errorf("%dx%d color space %d: reconstructed frame differs from source, mean abs diff %.2f", size.X, size.Y, cs, d)
+			}
+
+			enc.Close()
+		}
+	}
+}
+
+func TestEncodeRawOddSize(t *testing.T) {
+	opts := &Options{
+		Width:       641,
+		Height:      481,
+		FrameRate:   25,
+		Tune:        "zerolatency",
+		Preset:      "ultrafast",
+		Profile:     "high",
+		LogLevel:    LogError,
+		RateControl: RateControlCQP,
+		QP:          10,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	src := image.NewYCbCr(img.Rect, image.YCbCrSubsampleRatio420)
+
+	for y := 0; y < opts.Height; y++ {
+		for x := 0; x < opts.Width; x++ {
+			c := color.RGBA{uint8(x * 255 / opts.Width), uint8(y * 255 / opts.Height), 128, 255}
+			img.Set(x, y, c)
+
+			yy, cb, cr := RGBToYCbCrBT601(c.R, c.G, c.B)
+			src.Y[src.YOffset(x, y)] = yy
+			src.Cb[src.COffset(x, y)] = cb
+			src.Cr[src.COffset(x, y)] = cr
+		}
+	}
+
+	if src.YStride != 641 || src.CStride != 321 {
+		t.Fatalf("unexpected strides %d %d", src.YStride, src.CStride)
+	}
+
+	err = enc.EncodeRaw(src.Y, src.Cb, src.Cr, src.YStride, src.CStride)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for x264c.EncoderDelayedFrames(enc.e) > 0 {
+		_, _, err = enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := reconDiff(enc, img); d > 3 {
+		t.Errorf("reconstructed frame differs from source, mean abs diff %.2f", d)
+	}
+}
+
+// reconDiff returns mean absolute difference between the last reconstructed frame and src samples converted
+// with BT.601 studio range.
+func reconDiff(enc *Encoder, src *image.RGBA) float64 {
+	img := enc.picOut.Img
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	plane := func(i int) []byte {
+		return cslice(img.Plane[i], int(img.IStride[i])*h)
+	}
+
+	var sum float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := src.RGBAAt(x, y)
+			yy, cb, cr := RGBToYCbCrBT601(c.R, c.G, c.B)
+
+			var rcb, rcr byte
+			if img.IPlane == 3 {
+				rcb = plane(1)[y*int(img.IStride[1])+x]
+				rcr = plane(2)[y*int(img.IStride[2])+x]
+			} else {
+				// x264 keeps 4:2:0 and 4:2:2 chroma interleaved
+				cy := y / 2
+				if img.ICsp&x264c.CspMask == x264c.CspNv16 {
+					cy = y
+				}
+
+				off := cy*int(img.IStride[1]) + x/2*2
+				rcb, rcr = plane(1)[off], plane(1)[off+1]
+			}
+
+			sum += absDiff(plane(0)[y*int(img.IStride[0])+x], yy)
+			sum += absDiff(rcb, cb) + absDiff(rcr, cr)
+		}
+	}
+
+	return sum / float64(3*w*h)
+}
+
+func absDiff(a, b byte) float64 {
+	if a > b {
+		return float64(a - b)
+	}
+
+	return float64(b - a)
+}
+
+func TestEncodeGray(t *testing.T) {
+	for _, cs := range []int32{ColorSpaceI420, ColorSpaceI400} {
+		opts := &Options{
+			Width:       320,
+			Height:      240,
+			FrameRate:   25,
+			Tune:        "zerolatency",
+			Preset:      "ultrafast",
+			Profile:     "high",
+			LogLevel:    LogError,
+			RateControl: RateControlCQP,
+			QP:          10,
+			ColorSpace:  cs,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := image.NewGray(image.Rect(0, 0, opts.Width, opts.Height))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i % opts.Width)
+		}
+
+		b, _, err := enc.EncodeFrameInfo(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for b == nil && x264c.EncoderDelayedFrames(enc.e) > 0 {
+			b, _, err = enc.EncodeFrameInfo(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		recon := enc.picOut.Img
+		luma := cslice(recon.Plane[0], int(recon.IStride[0])*opts.Height)
+
+		var sum float64
+		for y := 0; y < opts.Height; y++ {
+			for x := 0; x < opts.Width; x++ {
+				sum += absDiff(luma[y*int(recon.IStride[0])+x], img.GrayAt(x, y).Y)
+			}
+		}
+
+		if d := sum / float64(opts.Width*opts.Height); d > 3 {
+			t.Errorf("color space %d: reconstructed luma differs from source, mean abs diff %.2f", cs, d)
+		}
+
+		if cs == ColorSpaceI420 {
+			chroma := cslice(recon.Plane[1], int(recon.IStride[1])*opts.Height/2)
+			if chroma[0] != 128 || chroma[1] != 128 {
+				t.Errorf("expected neutral chroma, got %d %d", chroma[0], chroma[1])
+			}
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeReset(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	var first, second bytes.Buffer
+
+	enc, err := NewEncoder(&first, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 5; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Reset(&second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := first.Len()
+
+	b, info, err := enc.EncodeFrameInfo(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for b == nil && x264c.EncoderDelayedFrames(enc.e) > 0 {
+		b, info, err = enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if info.PTS != 0 || info.Type != FrameIDR {
+		t.Errorf("unexpected first frame after reset %+v", info)
+	}
+
+	if first.Len() != n {
+		t.Error("data written to the previous writer after reset")
+	}
+
+	if !bytes.HasPrefix(second.Bytes(), []byte{0, 0, 0, 1, 0x67}) {
+		t.Error("expected new stream to start with SPS")
+	}
+
+	if enc.Stats().Frames != 1 {
+		t.Errorf("expected stats to restart, got %+v", enc.Stats())
+	}
+}
+
+func TestEncodeBFrames(t *testing.T) {
+	opts := &Options{
+		Width:          320,
+		Height:         240,
+		FrameRate:      25,
+		Preset:         "veryfast",
+		Profile:        "high",
+		LogLevel:       LogError,
+		BFrames:        2,
+		BFrameAdaptive: BFrameAdaptiveNone,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.IBframe != 2 || param.IBframeAdaptive != x264c.BAdaptNone {
+		t.Errorf("unexpected params bframes=%d adaptive=%d", param.IBframe, param.IBframeAdaptive)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := enc.Stats(); st.FramesB == 0 {
+		t.Errorf("expected B-frames, got %+v", st)
+	}
+}
+
+func TestEncodeSEIUserData(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uuid := [16]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	data := []byte("timecode 00:00:01:00")
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			enc.SetSEIUserData(uuid, data)
+		}
+
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc.Close()
+
+	payload := append(uuid[:], data...)
+	if n := bytes.Count(buf.Bytes(), payload); n != 1 {
+		t.Errorf("expected SEI payload once, found %d", n)
+	}
+}
+
+func TestEncodeClose(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := enc.Stats(); st.Frames != 10 {
+		t.Errorf("expected Close to flush 10 frames, got %d", st.Frames)
+	}
+
+	n := buf.Len()
+
+	err = enc.Close()
+	if err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	err = enc.Encode(img)
+	if err == nil {
+		t.Error("expected error encoding with closed encoder")
+	}
+
+	if buf.Len() != n {
+		t.Error("data written after Close")
+	}
+}
+
+func TestEncodeVUI(t *testing.T) {
+	opts := &Options{
+		Width:                   320,
+		Height:                  240,
+		FrameRate:               25,
+		Preset:                  "veryfast",
+		Profile:                 "high",
+		LogLevel:                LogError,
+		ColorRange:              ColorRangeFull,
+		ColorPrimaries:          "bt709",
+		TransferCharacteristics: "bt709",
+		ColorMatrix:             "bt709",
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	vui := param.Vui
+	if vui.BFullrange != 1 || vui.IColorprim != 1 || vui.ITransfer != 1 || vui.IColmatrix != 1 {
+		t.Errorf("unexpected VUI %+v", vui)
+	}
+
+	err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	headers := int64(buf.Len())
+
+	imgs := make([]image.Image, 10)
+	for i := range imgs {
+		img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{uint8(i * 25), 0, 0, 255}}, image.ZP, draw.Src)
+		imgs[i] = img
+	}
+
+	n, err := enc.EncodeBatch(imgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == 0 || n != int64(buf.Len())-headers {
+		t.Errorf("EncodeBatch returned %d bytes, buffer has %d", n, int64(buf.Len())-headers)
+	}
+}
+
+func TestEncodeIntraRefresh(t *testing.T) {
+	for _, refresh := range []bool{false, true} {
+		opts := &Options{
+			Width:        320,
+			Height:       240,
+			FrameRate:    25,
+			Tune:         "zerolatency",
+			Preset:       "ultrafast",
+			Profile:      "baseline",
+			LogLevel:     LogError,
+			KeyintMax:    10,
+			IntraRefresh: refresh,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+		for i := 0; i < 30; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		enc.Close()
+
+		idr := enc.Stats().FramesIDR
+		if refresh && idr != 1 {
+			t.Errorf("intra refresh: expected a single IDR frame, got %d", idr)
+		} else if !refresh && idr != 3 {
+			t.Errorf("expected an IDR frame every 10 frames, got %d", idr)
+		}
+	}
+}
+
+func TestEncodeDrain(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	emitted := enc.Stats().Frames
+	size := buf.Len()
+
+	delayed := enc.DelayedFrames()
+	if delayed != 10-emitted {
+		t.Errorf("DelayedFrames returned %d, want %d", delayed, 10-emitted)
+	}
+
+	frames, n, err := enc.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frames == 0 || emitted+frames != 10 {
+		t.Errorf("expected %d delayed frames, got %d", 10-emitted, frames)
+	}
+
+	if enc.DelayedFrames() != 0 {
+		t.Errorf("expected no delayed frames after Drain, got %d", enc.DelayedFrames())
+	}
+
+	if n != int64(buf.Len()-size) {
+		t.Errorf("Drain returned %d bytes, wrote %d", n, buf.Len()-size)
+	}
+}
+
+func TestEncodeLevel(t *testing.T) {
+	for _, tt := range []struct{ level, want string }{{"3.1", "3.1"}, {"4", "4.0"}, {"", "1.3"}} {
+		opts := &Options{
+			Width:     320,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    "veryfast",
+			Profile:   "high",
+			LogLevel:  LogError,
+			Level:     tt.level,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := enc.Level(); got != tt.want {
+			t.Errorf("Level %q: got %q, want %q", tt.level, got, tt.want)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeWithQP(t *testing.T) {
+	opts := &Options{
+		Width:       320,
+		Height:      240,
+		FrameRate:   25,
+		Tune:        "zerolatency",
+		Preset:      "veryfast",
+		Profile:     "high",
+		LogLevel:    LogError,
+		RateControl: RateControlCQP,
+		QP:          30,
+		QPI:         24,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	var qps []int
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			err = enc.EncodeWithQP(img, 26)
+		} else {
+			err = enc.Encode(img)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qps = append(qps, int(enc.picOut.IQpplus1)-1)
+	}
+
+	if qps[0] != 24 || qps[1] != 30 || qps[2] != 26 || qps[3] != 30 {
+		t.Errorf("unexpected frame quantizers %v", qps)
+	}
+
+	err = enc.EncodeWithQP(img, 52)
+	if err == nil {
+		t.Error("expected error for qp 52")
+	}
+}
+
+func TestEncodeImageSize(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 640, 480), image.Rect(0, 0, 320, 200)} {
+		err = enc.Encode(image.NewRGBA(r))
+		if err == nil {
+			t.Errorf("expected error for image size %v", r.Size())
+		}
+	}
+
+	big := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	draw.Draw(big, image.Rect(100, 100, 420, 340), image.White, image.ZP, draw.Src)
+
+	err = enc.Encode(big.SubImage(image.Rect(100, 100, 420, 340)))
+	if err != nil {
+		t.Errorf("unexpected error for sub image %v", err)
+	}
+
+	if enc.img.Y[0] != 235 || enc.img.Y[len(enc.img.Y)-1] != 235 {
+		t.Error("sub image was not drawn at the origin")
+	}
+}
+
+func TestEncodeResize(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		Resize:    true,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	// scaled and unscaled images are converted to the same studio range levels
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 640, 480), image.Rect(0, 0, 160, 120), image.Rect(50, 50, 1003, 333), image.Rect(0, 0, 320, 240)} {
+		im := image.NewRGBA(r)
+		draw.Draw(im, image.Rect(r.Min.X, r.Min.Y, r.Min.X+r.Dx()/2, r.Max.Y), image.White, image.ZP, draw.Src)
+		draw.Draw(im, image.Rect(r.Min.X+r.Dx()/2, r.Min.Y, r.Max.X, r.Max.Y), image.Black, image.ZP, draw.Src)
+
+		err = enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected error for image size %v: %v", r.Size(), err)
+		}
+
+		if y := enc.img.Y[enc.img.YOffset(10, 120)]; y != 235 {
+			t.Errorf("size %v: left luma %d, want 235", r.Size(), y)
+		}
+
+		if y := enc.img.Y[enc.img.YOffset(310, 120)]; y != 16 {
+			t.Errorf("size %v: right luma %d, want 16", r.Size(), y)
+		}
+	}
+}
+
+func TestEncodeResizeYCbCr(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		Resize:    true,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	// Y'CbCr and gray samples are scaled without conversion, at the levels unscaled images are copied with
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 640, 480), image.Rect(0, 0, 160, 120), image.Rect(0, 0, 320, 240)} {
+		half := image.Rect(r.Min.X, r.Min.Y, r.Min.X+r.Dx()/2, r.Max.Y)
+
+		gray := image.NewGray(r)
+		draw.Draw(gray, half, image.White, image.ZP, draw.Src)
+
+		ycc := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				ycc.Y[ycc.YOffset(x, y)] = 16
+				if x < r.Min.X+r.Dx()/2 {
+					ycc.Y[ycc.YOffset(x, y)] = 235
+				}
+
+				ycc.Cb[ycc.COffset(x, y)] = 100
+				ycc.Cr[ycc.COffset(x, y)] = 150
+			}
+		}
+
+		for _, tc := range []struct {
+			im                  image.Image
+			left, right, cb, cr byte
+		}{
+			{gray, 255, 0, 128, 128},
+			{ycc, 235, 16, 100, 150},
+		} {
+			err = enc.Encode(tc.im)
+			if err != nil {
+				t.Fatalf("unexpected error for %T size %v: %v", tc.im, r.Size(), err)
+			}
+
+			if y := enc.img.Y[enc.img.YOffset(10, 120)]; y != tc.left {
+				t.Errorf("%T size %v: left luma %d, want %d", tc.im, r.Size(), y, tc.left)
+			}
+
+			if y := enc.img.Y[enc.img.YOffset(310, 120)]; y != tc.right {
+				t.Errorf("%T size %v: right luma %d, want %d", tc.im, r.Size(), y, tc.right)
+			}
+
+			if i := enc.img.COffset(10, 120); enc.img.Cb[i] != tc.cb || enc.img.Cr[i] != tc.cr {
+				t.Errorf("%T size %v: chroma %d, %d, want %d, %d", tc.im, r.Size(), enc.img.Cb[i], enc.img.Cr[i], tc.cb, tc.cr)
+			}
+		}
+	}
+}
+
+func TestNewReaderEncoder(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, r, err := NewReaderEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		for i := 0; i < 25; i++ {
+			if err := enc.Encode(img); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- enc.Close()
+	}()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) == 0 || !bytes.HasPrefix(b, []byte{0, 0, 0, 1}) {
+		t.Errorf("unexpected stream of %d bytes", len(b))
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	ring := newRingBuffer(7)
+
+	src := make([]byte, 1000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	go func() {
+		for i := 0; i < len(src); i += 13 {
+			end := i + 13
+			if end > len(src) {
+				end = len(src)
+			}
+
+			if _, err := ring.Write(src[i:end]); err != nil {
+				ring.closeWrite(err)
+				return
+			}
+		}
+
+		ring.closeWrite(nil)
+	}()
+
+	dst, err := ioutil.ReadAll(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dst, src) {
+		t.Error("ring buffer corrupted the stream")
+	}
+
+	ring = newRingBuffer(4)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ring.Write(make([]byte, 10))
+		done <- err
+	}()
+
+	ring.Close()
+
+	if err = <-done; !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected io.ErrClosedPipe after reader close, got %v", err)
+	}
+}
+
+func TestEncodeRCLookahead(t *testing.T) {
+	for _, tc := range []struct {
+		lookahead int
+		want      int32
+	}{{10, 10}, {-1, 0}} {
+		opts := &Options{
+			Width:       320,
+			Height:      240,
+			FrameRate:   25,
+			Preset:      "veryfast",
+			Profile:     "high",
+			LogLevel:    LogError,
+			RCLookahead: tc.lookahead,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		if param.Rc.ILookahead != tc.want {
+			t.Errorf("RCLookahead %d: got lookahead %d, want %d", tc.lookahead, param.Rc.ILookahead, tc.want)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeWithQuantOffsets(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := range img.Y {
+		img.Y[i] = byte(i * 7919 >> 3)
+	}
+
+	size := func(offset float32) int {
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer enc.Close()
+
+		err = enc.EncodeWithQuantOffsets(img, make([]float32, 10))
+		if err == nil {
+			t.Error("expected error for short offsets")
+		}
+
+		offsets := make([]float32, 20*15)
+		for i := range offsets {
+			offsets[i] = offset
+		}
+
+		err = enc.EncodeWithQuantOffsets(img, offsets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = enc.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Len()
+	}
+
+	if lo, hi := size(10), size(-10); lo >= hi {
+		t.Errorf("expected negative offsets to raise frame size, got %d for +10 and %d for -10", lo, hi)
+	}
+}
+
+func TestEncodeLogger(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogInfo,
+		Logger: func(level int, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if level > int(LogInfo) {
+				t.Errorf("unexpected level %d for %q", level, msg)
+			}
+
+			lines = append(lines, msg)
+		},
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(lines) == 0 {
+		t.Fatal("expected log lines")
+	}
+
+	for _, l := range lines {
+		if strings.HasSuffix(l, "\n") {
+			t.Errorf("log line %q has trailing newline", l)
+		}
+	}
+
+	if len(loggers) != 0 {
+		t.Errorf("expected logger to be unregistered, %d left", len(loggers))
+	}
+}
+
+func TestEncodeTwoPass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x264")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	opts := &Options{
+		Width:       320,
+		Height:      240,
+		FrameRate:   25,
+		Preset:      "veryfast",
+		Profile:     "high",
+		LogLevel:    LogError,
+		RateControl: RateControlABR,
+		Bitrate:     500,
+		StatsFile:   filepath.Join(dir, "stats.log"),
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for pass := 1; pass <= 2; pass++ {
+		opts.Pass = pass
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+
+		for i := 0; i < 25; i++ {
+			for j := range img.Y {
+				img.Y[j] = byte(i*3 + j*j>>5)
+			}
+
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatalf("pass %d: %v", pass, err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+
+		if _, err = os.Stat(opts.StatsFile); err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+	}
+}
+
+// shortWriter accepts at most n bytes per Write.
+type shortWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeShortWrite(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &shortWriter{n: 7}
+	short, err := NewEncoder(w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*Encoder{enc, short} {
+		for i := 0; i < 10; i++ {
+			err = e.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = e.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(w.Bytes(), buf.Bytes()) {
+		t.Errorf("short writes produced %d bytes, want %d", w.Len(), buf.Len())
+	}
+
+	w.n = 0
+	zero, err := NewEncoder(w, opts)
+	if err == nil {
+		zero.Close()
+		t.Error("expected error for writer accepting nothing")
+	}
+}
+
+func TestEncodeAQ(t *testing.T) {
+	for _, tc := range []struct {
+		mode     int32
+		strength float32
+		want     int32
+	}{{AQModeNone, 0, x264c.AqNone}, {AQModeAutoVariance, 1.5, x264c.AqAutovariance}} {
+		opts := &Options{
+			Width:      320,
+			Height:     240,
+			FrameRate:  25,
+			Preset:     "veryfast",
+			Profile:    "high",
+			LogLevel:   LogError,
+			AQMode:     tc.mode,
+			AQStrength: tc.strength,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		// with mb-tree x264 turns disabled AQ into variance AQ of zero strength
+		if tc.want == x264c.AqNone && param.Rc.FAqStrength == 0 {
+			param.Rc.IAqMode = x264c.AqNone
+		}
+
+		if param.Rc.IAqMode != tc.want {
+			t.Errorf("AQMode %d: got aq mode %d, want %d", tc.mode, param.Rc.IAqMode, tc.want)
+		}
+
+		if tc.strength > 0 && param.Rc.FAqStrength != tc.strength {
+			t.Errorf("AQStrength %v: got %v", tc.strength, param.Rc.FAqStrength)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Preset:        "veryfast",
+		Profile:       "high",
+		LogLevel:      LogError,
+		Deterministic: true,
+	}
+
+	encode := func() []byte {
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		if param.IThreads != 1 || param.BCpuIndependent != 1 {
+			t.Errorf("unexpected params threads=%d cpu independent=%d", param.IThreads, param.BCpuIndependent)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		for i := 0; i < 25; i++ {
+			for j := range img.Y {
+				img.Y[j] = byte(i*5 + j*j>>7)
+			}
+
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+	}
+
+	if a, b := encode(), encode(); !bytes.Equal(a, b) {
+		t.Errorf("outputs differ, %d and %d bytes", len(a), len(b))
+	}
+}
+
+// bitReader reads Exp-Golomb coded RBSP bits.
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) u(n int) (v int) {
+	for i := 0; i < n; i++ {
+		bit := 0
+		if r.pos/8 < len(r.b) {
+			bit = int(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+		}
+		v = v<<1 | bit
+		r.pos++
+	}
+
+	return
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.u(1) == 0 && zeros < 32 {
+		zeros++
+	}
+
+	return 1<<uint(zeros) - 1 + r.u(zeros)
+}
+
+// spsDisplaySize returns the cropped picture size signaled by sps, without scaling lists support.
+func spsDisplaySize(sps []byte) (w, h int) {
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+
+	r := &bitReader{b: rbsp}
+	profile := r.u(8)
+	r.u(16)
+	r.ue()
+
+	chroma := 1
+	if profile >= 100 {
+		chroma = r.ue()
+		if chroma == 3 {
+			r.u(1)
+		}
+		r.ue()
+		r.ue()
+		r.u(1)
+		r.u(1)
+	}
+
+	r.ue()
+	if r.ue() == 0 {
+		r.ue()
+	}
+	r.ue()
+	r.u(1)
+
+	w = (r.ue() + 1) * 16
+	mapUnits := r.ue() + 1
+
+	// field coded streams count height in macroblock pairs
+	frameMbsOnly := r.u(1)
+	h = (2 - frameMbsOnly) * mapUnits * 16
+	if frameMbsOnly == 0 {
+		r.u(1)
+	}
+	r.u(1)
+
+	if r.u(1) == 1 {
+		cx, cy := 1, 2-frameMbsOnly
+		if chroma == 1 || chroma == 2 {
+			cx = 2
+		}
+		if chroma == 1 {
+			cy *= 2
+		}
+
+		w -= cx * (r.ue() + r.ue())
+		h -= cy * (r.ue() + r.ue())
+	}
+
+	return
+}
+
+func TestEncodeCrop(t *testing.T) {
+	for _, tc := range []struct {
+		cs                       int32
+		left, top, right, bottom int
+		w, h                     int
+	}{
+		{ColorSpaceI420, 0, 0, 0, 0, 330, 246},
+		{ColorSpaceI420, 4, 0, 0, 6, 326, 240},
+		{ColorSpaceI422, 2, 3, 0, 1, 328, 242},
+		{ColorSpaceI444, 1, 3, 0, 0, 329, 243},
+	} {
+		opts := &Options{
+			Width:      330,
+			Height:     246,
+			FrameRate:  25,
+			Preset:     "veryfast",
+			Profile:    "high444",
+			LogLevel:   LogError,
+			ColorSpace: tc.cs,
+			CropLeft:   tc.left,
+			CropTop:    tc.top,
+			CropRight:  tc.right,
+			CropBottom: tc.bottom,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sps, _, err := enc.Headers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w, h := spsDisplaySize(sps); w != tc.w || h != tc.h {
+			t.Errorf("crop %d,%d,%d,%d: display size %dx%d, want %dx%d", tc.left, tc.top, tc.right, tc.bottom, w, h, tc.w, tc.h)
+		}
+
+		err = enc.Encode(image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeSetNextFrameType(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		KeyintMin: 10,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	if err = enc.SetNextFrameType(FrameB); err == nil {
+		t.Error("expected error forcing a B-frame with B-frames disabled")
+	}
+
+	if err = enc.SetNextFrameType(FrameType(42)); err == nil {
+		t.Error("expected error for unknown frame type")
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i, want := range []FrameType{FrameIDR, FrameP, FrameI, FrameP, FrameIDR} {
+		if i > 0 && want != FrameP {
+			err = enc.SetNextFrameType(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, info, err := enc.EncodeFrameInfo(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Type != want {
+			t.Errorf("frame %d: type %d, want %d", i, info.Type, want)
+		}
+	}
+}
+
+func TestEncodeLastFrameSize(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	total := 0
+
+	for i := 0; i < 10 || enc.DelayedFrames() > 0; i++ {
+		var in image.Image
+		if i < 10 {
+			in = img
+		}
+
+		b, info, err := enc.EncodeFrameInfo(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enc.LastFrameSize() != len(b) {
+			t.Errorf("frame %d: LastFrameSize %d, want %d", i, enc.LastFrameSize(), len(b))
+		}
+
+		if enc.LastFrameKeyframe() != (len(b) > 0 && info.Keyframe) {
+			t.Errorf("frame %d: LastFrameKeyframe %v, want %v", i, enc.LastFrameKeyframe(), info.Keyframe)
+		}
+
+		if total == 0 && len(b) > 0 && !enc.LastFrameKeyframe() {
+			t.Error("expected first output frame to be a keyframe")
+		}
+
+		total += enc.LastFrameSize()
+	}
+
+	if int64(total) != enc.Stats().Bytes {
+		t.Errorf("frame sizes add up to %d, want %d", total, enc.Stats().Bytes)
+	}
+}
+
+func TestEncodeNV21RGB24(t *testing.T) {
+	opts := &Options{
+		Width:     321,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	cw, ch := (opts.Width+1)/2, (opts.Height+1)/2
+
+	y := bytes.Repeat([]byte{100}, opts.Width*opts.Height)
+	vu := bytes.Repeat([]byte{200, 50}, cw*ch)
+
+	err = enc.EncodeNV21(y, vu)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.img.Y[0] != 100 || enc.img.Cb[0] != 50 || enc.img.Cr[0] != 200 {
+		t.Errorf("unexpected NV21 conversion y=%d cb=%d cr=%d", enc.img.Y[0], enc.img.Cb[0], enc.img.Cr[0])
+	}
+
+	err = enc.EncodeNV21(y, vu[:10])
+	if err == nil {
+		t.Error("expected error for short NV21 planes")
+	}
+
+	stride := 3*opts.Width + 1
+	pix := make([]byte, stride*opts.Height)
+	for i := 0; i < opts.Height; i++ {
+		for j := 0; j < opts.Width; j++ {
+			pix[i*stride+3*j] = 255
+		}
+	}
+
+	err = enc.EncodeRGB24(pix, stride)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.img.Y[0] != 81 || enc.img.Cr[0] != 240 {
+		t.Errorf("unexpected RGB24 conversion y=%d cr=%d", enc.img.Y[0], enc.img.Cr[0])
+	}
+
+	err = enc.EncodeRGB24(pix, 3*opts.Width-1)
+	if err == nil {
+		t.Error("expected error for short RGB24 stride")
+	}
+}
+
+// errWriter fails every Write.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestEncodeAddWriter(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := buf.Len()
+
+	var tee bytes.Buffer
+	enc.AddWriter(errWriter{})
+	enc.AddWriter(&tee)
+
+	err = enc.Encode(img)
+	if err == nil || !strings.Contains(err.Error(), "errWriter") {
+		t.Errorf("expected error naming the failed writer, got %v", err)
+	}
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Errorf("expected failed writer to be dropped, got %v", err)
+	}
+
+	if !bytes.Equal(tee.Bytes(), buf.Bytes()[size:]) {
+		t.Errorf("added writer got %d bytes, want %d", tee.Len(), buf.Len()-size)
+	}
+}
+
+func TestPool(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "baseline",
+		LogLevel:  LogError,
+	}
+
+	pool, err := NewPool(opts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	bufs := make([]bytes.Buffer, 6)
+
+	for i := range bufs {
+		wg.Add(1)
+
+		go func(buf *bytes.Buffer) {
+			defer wg.Done()
+
+			enc, err := pool.Get(buf)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer pool.Put(enc)
+
+			img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+			for j := 0; j < 5; j++ {
+				if err := enc.Encode(img); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			if err := enc.Flush(); err != nil {
+				t.Error(err)
+			}
+
+			if st := enc.Stats(); st.Frames != 5 {
+				t.Errorf("expected 5 frames in a fresh stream, got %d", st.Frames)
+			}
+		}(&bufs[i])
+	}
+
+	wg.Wait()
+
+	for i := range bufs {
+		// SPS NAL unit follows the first start code
+		if b := bufs[i].Bytes(); len(b) < 5 || !bytes.HasPrefix(b, []byte{0, 0, 0, 1, 0x67}) {
+			t.Errorf("stream %d does not start with SPS", i)
+		}
+	}
+
+	enc, err := pool.Get(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc.Close()
+	pool.Put(enc)
+
+	enc, err = pool.Get(ioutil.Discard)
+	if err != nil {
+		t.Fatalf("expected closed encoder to be replaced, got %v", err)
+	}
+
+	err = enc.ChangeResolution(640, 480)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Put(enc)
+
+	// both encoders are taken, so the resized one is among them
+	encs := make([]*Encoder, 2)
+	for i := range encs {
+		encs[i], err = pool.Get(ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, enc := range encs {
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+		if int(param.IWidth) != opts.Width || int(param.IHeight) != opts.Height {
+			t.Errorf("expected pool encoder at %dx%d, got %dx%d", opts.Width, opts.Height, param.IWidth, param.IHeight)
+		}
+
+		pool.Put(enc)
+	}
+
+	for _, size := range []int{0, -1} {
+		if _, err := NewPool(opts, size); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("size %d: expected ErrInvalidOptions, got %v", size, err)
+		}
+	}
+}
+
+func TestPoolReconfig(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Tune:          "zerolatency",
+		Preset:        "veryfast",
+		Profile:       "baseline",
+		LogLevel:      LogError,
+		RateControl:   RateControlABR,
+		Bitrate:       1000,
+		VBVMaxRate:    1000,
+		VBVBufferSize: 1000,
+	}
+
+	pool, err := NewPool(opts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pool.Close()
+
+	enc, err := pool.Get(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := *opts
+	o.Bitrate, o.VBVMaxRate, o.VBVBufferSize = 200, 200, 200
+
+	err = enc.Reconfig(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Put(enc)
+
+	enc, err = pool.Get(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pool.Put(enc)
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+	if param.Rc.IBitrate != 1000 || param.Rc.IVbvMaxBitrate != 1000 {
+		t.Errorf("expected pool bitrate 1000, got bitrate %d and VBV max rate %d", param.Rc.IBitrate, param.Rc.IVbvMaxBitrate)
+	}
+
+	if enc.opts.Bitrate != opts.Bitrate {
+		t.Errorf("expected pool options bitrate %d, got %d", opts.Bitrate, enc.opts.Bitrate)
+	}
+}
+
+// failWriter fails or panics on Write when set.
+type failWriter struct {
+	fail, panic bool
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.panic {
+		panic("write")
+	}
+
+	if w.fail {
+		return 0, io.ErrClosedPipe
+	}
+
+	return len(p), nil
+}
+
+func TestEncodeWriterFailure(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	released := func(enc *Encoder) bool {
+		for _, p := range enc.cplanes {
+			if p != nil {
+				return false
+			}
+		}
+
+		return enc.e == nil
+	}
+
+	w := &failWriter{}
+	enc, err := NewEncoder(w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		w.fail = i%3 == 2
+
+		err = enc.Encode(img)
+		if w.fail && enc.LastFrameSize() > 0 && !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("frame %d: expected writer error, got %v", i, err)
+		} else if !w.fail && err != nil {
+			t.Errorf("frame %d: expected encoder to recover, got %v", i, err)
+		}
+	}
+
+	w.fail = true
+
+	err = enc.Close()
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected Close to return writer error, got %v", err)
+	}
+
+	if !released(enc) {
+		t.Error("encoder not released after write error")
+	}
+
+	w = &failWriter{}
+	enc, err = NewEncoder(w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.panic = true
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected writer panic")
+			}
+		}()
+
+		enc.Close()
+	}()
+
+	if !released(enc) {
+		t.Error("encoder not released after writer panic")
+	}
+}
+
+func TestEncodeOpenGOP(t *testing.T) {
+	for _, open := range []bool{false, true} {
+		opts := &Options{
+			Width:     320,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    "veryfast",
+			Profile:   "high",
+			LogLevel:  LogError,
+			KeyintMax: 10,
+			OpenGOP:   open,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		for i := 0; i < 30; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st := enc.Stats()
+		if open && (st.FramesIDR != 1 || st.FramesI < 3) {
+			t.Errorf("open GOP: expected one IDR frame followed by I-frames, got %+v", st)
+		} else if !open && st.FramesIDR < 3 {
+			t.Errorf("closed GOP: expected IDR frames, got %+v", st)
+		}
+	}
+}
+
+func TestEncodeDeferHeaders(t *testing.T) {
+	opts := &Options{
+		Width:        320,
+		Height:       240,
+		FrameRate:    25,
+		Tune:         "zerolatency",
+		Preset:       "veryfast",
+		Profile:      "baseline",
+		LogLevel:     LogError,
+		DeferHeaders: true,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output before WriteHeaders, got %d bytes", buf.Len())
+	}
+
+	err = enc.WriteHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0, 0, 0, 1, 0x67}) {
+		t.Error("expected headers to start with SPS")
+	}
+
+	var reset bytes.Buffer
+	err = enc.Reset(&reset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reset.Len() != 0 {
+		t.Errorf("expected Reset to defer headers, got %d bytes", reset.Len())
+	}
+}
+
+func TestEncodePsyDeblock(t *testing.T) {
+	opts := &Options{
+		Width:        320,
+		Height:       240,
+		FrameRate:    25,
+		Tune:         "film",
+		Preset:       "medium",
+		Profile:      "high",
+		LogLevel:     LogError,
+		PsyRD:        1.5,
+		PsyTrellis:   -1,
+		DeblockAlpha: 2,
+		DeblockBeta:  -3,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.Analyse.FPsyRd != 1.5 || param.Analyse.FPsyTrellis != 0 {
+		t.Errorf("unexpected psy params rd=%v trellis=%v", param.Analyse.FPsyRd, param.Analyse.FPsyTrellis)
+	}
+
+	if param.IDeblockingFilterAlphac0 != 2 || param.IDeblockingFilterBeta != -3 {
+		t.Errorf("unexpected deblock params %d:%d", param.IDeblockingFilterAlphac0, param.IDeblockingFilterBeta)
+	}
+}
+
+func TestEncodeRawPointer(t *testing.T) {
+	for _, width := range []int{320, 321} {
+		opts := &Options{
+			Width:     width,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    "veryfast",
+			Profile:   "high",
+			LogLevel:  LogError,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// planes of a C allocated picture, outside the Go heap
+		var pic x264c.Picture
+		if x264c.PictureAlloc(&pic, x264c.CspI420, int32(enc.width), 240) < 0 {
+			t.Fatal("cannot allocate picture")
+		}
+
+		planes := []unsafe.Pointer{pic.Img.Plane[0], pic.Img.Plane[1], pic.Img.Plane[2]}
+		strides := []int{int(pic.Img.IStride[0]), int(pic.Img.IStride[1]), int(pic.Img.IStride[2])}
+		sizes := []int{strides[0] * 240, strides[1] * 120, strides[2] * 120}
+
+		for i := 0; i < 5; i++ {
+			err = enc.EncodeRawPointer(planes, sizes, strides)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.EncodeRawPointer(planes[:2], sizes[:2], strides[:2])
+		if err == nil {
+			t.Error("expected error for missing plane")
+		}
+
+		err = enc.EncodeRawPointer(planes, []int{10, sizes[1], sizes[2]}, strides)
+		if err == nil {
+			t.Error("expected error for short plane")
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st := enc.Stats(); st.Frames != 5 {
+			t.Errorf("width %d: expected 5 frames, got %d", width, st.Frames)
+		}
+
+		x264c.PictureClean(&pic)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	bad := *opts
+	bad.Preset = "unknown"
+
+	_, err := NewEncoder(ioutil.Discard, &bad)
+	if !errors.Is(err, ErrInvalidPreset) || !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidPreset, got %v", err)
+	}
+
+	bad = *opts
+	bad.FrameRate = -1
+
+	_, err = NewEncoder(ioutil.Discard, &bad)
+	if !errors.Is(err, ErrInvalidOptions) || errors.Is(err, ErrInvalidPreset) {
+		t.Errorf("expected ErrInvalidOptions, got %v", err)
+	}
+
+	w := &failWriter{}
+	enc, err := NewEncoder(w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Encode(NewYCbCr(image.Rect(0, 0, 16, 16)))
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got %v", err)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := 0; i < 5; i++ {
+		if err = enc.Encode(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.fail = true
+
+	err = enc.Close()
+	if !errors.Is(err, ErrWrite) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected ErrWrite wrapping writer error, got %v", err)
+	}
+
+	err = enc.Encode(img)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestEncodeSliceMaxSize(t *testing.T) {
+	opts := &Options{
+		Width:        320,
+		Height:       240,
+		FrameRate:    25,
+		Tune:         "zerolatency",
+		Preset:       "veryfast",
+		Profile:      "high",
+		LogLevel:     LogError,
+		SliceMaxSize: 1200,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 5; i++ {
+		for j := range img.Y {
+			img.Y[j] = uint8(j*j*(i+1) + j/7)
+		}
+
+		nals, err := enc.EncodeNALs(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slices := 0
+		for _, nal := range nals {
+			if nal.Type != NALSlice && nal.Type != NALSliceIDR {
+				continue
+			}
+
+			slices++
+			if len(nal.Payload) > opts.SliceMaxSize {
+				t.Errorf("frame %d: slice of %d bytes exceeds %d", i, len(nal.Payload), opts.SliceMaxSize)
+			}
+		}
+
+		if i == 0 && slices < 2 {
+			t.Errorf("expected the keyframe to be split, got %d slices", slices)
+		}
+	}
+}
+
+func TestEncodeSlices(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		BFrames:   -1,
+		Slices:    4,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	frames := 0
+	for i := 0; i < 30; i++ {
+		nals, err := enc.EncodeNALs(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(nals) == 0 {
+			continue
+		}
+
+		frames++
+		slices := 0
+		for _, nal := range nals {
+			if nal.Type == NALSlice || nal.Type == NALSliceIDR {
+				slices++
+			}
+		}
+
+		if slices != opts.Slices {
+			t.Errorf("expected %d slices, got %d", opts.Slices, slices)
+		}
+	}
+
+	if frames == 0 {
+		t.Error("expected encoded frames")
+	}
+}
+
+func TestEncodeNoRepeatHeaders(t *testing.T) {
+	for _, repeat := range []bool{true, false} {
+		opts := &Options{
+			Width:           320,
+			Height:          240,
+			FrameRate:       25,
+			Tune:            "zerolatency",
+			Preset:          "veryfast",
+			Profile:         "baseline",
+			LogLevel:        LogError,
+			KeyintMax:       5,
+			NoRepeatHeaders: !repeat,
+		}
+
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+		sps := 0
+		if buf.Len() > 0 {
+			sps++
+		}
+
+		idr := 0
+		for i := 0; i < 20; i++ {
+			nals, err := enc.EncodeNALs(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, nal := range nals {
+				switch nal.Type {
+				case NALSPS:
+					sps++
+				case NALSliceIDR:
+					idr++
+				}
+			}
+		}
+
+		enc.Close()
+
+		if idr < 4 {
+			t.Fatalf("expected periodic IDR frames, got %d", idr)
+		}
+
+		if repeat && sps != idr+1 {
+			t.Errorf("expected SPS with every IDR frame, got %d for %d", sps, idr)
+		} else if !repeat && sps != 1 {
+			t.Errorf("expected a single SPS, got %d", sps)
+		}
+	}
+}
+
+func TestEncodeNRGBA(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := image.NewNRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.NRGBA{255, 255, 255, 128}}, image.ZP, draw.Src)
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the draw path would premultiply to gray
+	if enc.img.Y[0] != 235 || enc.img.Cb[0] != 128 {
+		t.Errorf("unexpected converted color y=%d cb=%d", enc.img.Y[0], enc.img.Cb[0])
+	}
+}
+
+func TestEncodeOnFrame(t *testing.T) {
+	var infos []FrameInfo
+	var size int
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnFrame: func(info FrameInfo, b []byte) {
+			infos = append(infos, info)
+			size += len(b)
+		},
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := buf.Len()
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 20; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = enc.EncodeFrame(img); err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infos) != 20 {
+		t.Fatalf("expected 20 frames, got %d", len(infos))
+	}
+
+	if !infos[0].Keyframe || infos[0].PTS != 0 {
+		t.Errorf("unexpected first frame %+v", infos[0])
+	}
+
+	if size != buf.Len()-headers {
+		t.Errorf("callback received %d bytes, writer %d", size, buf.Len()-headers)
+	}
+}
+
+func TestEncodeChromaSubsampling(t *testing.T) {
+	for _, tc := range []struct {
+		cs      int32
+		profile string
+		cw, ch  int
+	}{
+		{ColorSpaceI422, "high422", 160, 240},
+		{ColorSpaceI444, "high444", 320, 240},
+	} {
+		opts := &Options{
+			Width:       320,
+			Height:      240,
+			FrameRate:   25,
+			Tune:        "zerolatency",
+			Preset:      "ultrafast",
+			Profile:     tc.profile,
+			LogLevel:    LogError,
+			RateControl: RateControlCQP,
+			QP:          10,
+			ColorSpace:  tc.cs,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// alternating red and blue pixels, columns for 4:4:4 and rows for 4:2:2, lost if chroma is downsampled
+		img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+		for y := 0; y < opts.Height; y++ {
+			for x := 0; x < opts.Width; x++ {
+				c := color.RGBA{255, 0, 0, 255}
+				if (tc.cs == ColorSpaceI444 && x%2 == 1) || (tc.cs == ColorSpaceI422 && y%2 == 1) {
+					c = color.RGBA{0, 0, 255, 255}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+
+		b, err := enc.EncodeFrame(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b) == 0 {
+			t.Fatalf("color space %d: no frame encoded", tc.cs)
+		}
+
+		if cw, ch := enc.planeSize(1, opts.Width, opts.Height); cw != tc.cw || ch != tc.ch || enc.img.CStride != tc.cw {
+			t.Errorf("color space %d: chroma plane %dx%d stride %d, want %dx%d", tc.cs, cw, ch, enc.img.CStride, tc.cw, tc.ch)
+		}
+
+		// Cb of the reconstructed red and blue pixels, x264 keeps 4:2:2 chroma interleaved
+		pic := enc.picOut.Img
+		cb := cslice(pic.Plane[1], int(pic.IStride[1])*opts.Height)
+		red, blue := cb[0], cb[1]
+		if tc.cs == ColorSpaceI422 {
+			blue = cb[pic.IStride[1]]
+		}
+
+		if int(blue)-int(red) < 100 {
+			t.Errorf("color space %d: expected full resolution chroma, got cb %d and %d", tc.cs, red, blue)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeFlushPartial(t *testing.T) {
+	var infos []FrameInfo
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		KeyintMax: 250,
+		OnFrame: func(info FrameInfo, b []byte) {
+			infos = append(infos, info)
+		},
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for segment := 0; segment < 2; segment++ {
+		for i := 0; i < 10; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.FlushPartial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(infos) != 10*(segment+1) || enc.DelayedFrames() != 0 {
+			t.Fatalf("segment %d: expected all frames flushed, got %d", segment, len(infos))
+		}
+	}
+
+	n := buf.Len()
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != n {
+		t.Error("expected nothing left to flush on Close")
+	}
+
+	first := infos[10]
+	for _, info := range infos[10:] {
+		if info.PTS < first.PTS {
+			first = info
+		}
+	}
+
+	if first.PTS != 10 || first.Type != FrameIDR {
+		t.Errorf("expected segment to start with IDR frame at PTS 10, got %+v", first)
+	}
+
+	if st := enc.Stats(); st.Frames != 20 || st.FramesIDR != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	two := *opts
+	two.Pass = 1
+	two.StatsFile = filepath.Join(t.TempDir(), "stats.log")
+
+	enc, err = NewEncoder(ioutil.Discard, &two)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	if err = enc.FlushPartial(); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected two-pass error, got %v", err)
+	}
+}
+
+func TestEncodeImageTypes(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	r := image.Rect(0, 0, opts.Width, opts.Height)
+
+	for _, im := range []image.Image{
+		image.NewRGBA(r),
+		image.NewNRGBA(r),
+		image.NewGray(r),
+		NewYCbCr(r),
+		image.NewYCbCr(r, image.YCbCrSubsampleRatio420),
+		// as decoded from 4:2:2 JPEGs
+		image.NewYCbCr(r, image.YCbCrSubsampleRatio422),
+	} {
+		if err = enc.Encode(im); err != nil {
+			t.Errorf("%T: %v", im, err)
+		}
+	}
+
+	for _, im := range []image.Image{
+		image.NewCMYK(r),
+		image.NewPaletted(r, color.Palette{color.Black, color.White}),
+		image.NewRGBA64(r),
+	} {
+		if err = enc.Encode(im); !errors.Is(err, ErrInvalidInput) || !strings.Contains(err.Error(), "unsupported") {
+			t.Errorf("%T: expected unsupported image type error, got %v", im, err)
+		}
+	}
+}
+
+func TestEncodeTelemetry(t *testing.T) {
+	var snaps []TelemetrySnapshot
+
+	opts := &Options{
+		Width:             320,
+		Height:            240,
+		FrameRate:         25,
+		Tune:              "zerolatency",
+		Preset:            "veryfast",
+		Profile:           "high",
+		LogLevel:          LogError,
+		RateControl:       RateControlABR,
+		Bitrate:           500,
+		VBVMaxRate:        500,
+		VBVBufferSize:     500,
+		TelemetryInterval: 10,
+		Telemetry: func(s TelemetrySnapshot) {
+			snaps = append(snaps, s)
+		},
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 50; i++ {
+		for j := range img.Y {
+			img.Y[j] = uint8(j*(i+1) + j*j/5)
+		}
+
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(snaps) != 5 {
+		t.Fatalf("expected 5 snapshots, got %d", len(snaps))
+	}
+
+	var kbits float64
+	for i, s := range snaps {
+		if s.Frames != 10*(i+1) || s.Bitrate <= 0 || s.VBVFullness < 0 || s.VBVFullness > 1 {
+			t.Errorf("unexpected snapshot %d %+v", i, s)
+		}
+
+		kbits += s.Bitrate * 10 / 25
+	}
+
+	// the snapshots cover all frames
+	if st := enc.Stats(); math.Abs(kbits-float64(st.Bytes)*8/1000) > 0.1 {
+		t.Errorf("snapshot bitrates sum to %.1f kbits, encoded %.1f", kbits, float64(st.Bytes)*8/1000)
+	}
+
+	if snaps[4].VBVFullness == 0 {
+		t.Error("expected VBV buffer estimate with complex frames")
+	}
+}
+
+func TestEncodeExtra(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		Extra:     map[string]string{"me": "umh", "subme": "7", "keyint": "60"},
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.Analyse.IMeMethod != x264c.MeUmh || param.Analyse.ISubpelRefine != 7 || param.IKeyintMax != 60 {
+		t.Errorf("extra parameters not applied, me=%d subme=%d keyint=%d", param.Analyse.IMeMethod, param.Analyse.ISubpelRefine, param.IKeyintMax)
+	}
+
+	changed := enc.Options()
+	changed.Extra = map[string]string{"me": "hex"}
+	if err = enc.Reconfig(&changed); err == nil || !strings.Contains(err.Error(), "Extra") {
+		t.Errorf("expected Extra reconfig error, got %v", err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extra := range []map[string]string{{"no-such-param": "1"}, {"subme": "fast"}} {
+		bad := *opts
+		bad.Extra = extra
+
+		for name := range extra {
+			_, err = NewEncoder(ioutil.Discard, &bad)
+			if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), name) {
+				t.Errorf("expected error naming %s, got %v", name, err)
+			}
+		}
+	}
+}
+
+func TestEncodeInterlaced(t *testing.T) {
+	for _, bff := range []bool{false, true} {
+		opts := &Options{
+			Width:            320,
+			Height:           240,
+			FrameRate:        25,
+			Preset:           "veryfast",
+			Profile:          "high",
+			LogLevel:         LogError,
+			Interlaced:       true,
+			BottomFieldFirst: bff,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		if param.BInterlaced != 1 || (param.BTff == 0) != bff {
+			t.Errorf("bff %v: unexpected interlaced=%d tff=%d", bff, param.BInterlaced, param.BTff)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		for i := 0; i < 10; i++ {
+			if err = enc.Encode(img); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sps, _, err := enc.Headers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// frame_mbs_only_flag is cleared, the size is coded in field macroblock pairs
+		if w, h := spsDisplaySize(sps); w != 320 || h != 240 {
+			t.Errorf("unexpected display size %dx%d", w, h)
+		}
+
+		if err = enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if st := enc.Stats(); st.Frames != 10 {
+			t.Errorf("expected 10 frames, got %d", st.Frames)
+		}
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+
+	for _, noRepeat := range []bool{false, true} {
+		o := *opts
+		o.NoRepeatHeaders = noRepeat
+
+		b, err := EncodeImage(img, &o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count := make(map[int32]int)
+		for _, part := range bytes.Split(b, []byte{0, 0, 1}) {
+			if len(part) > 0 {
+				count[int32(part[0]&0x1f)]++
+			}
+		}
+
+		if count[NALSPS] != 1 || count[NALPPS] != 1 || count[NALSliceIDR] != 1 || count[NALSlice] != 0 {
+			t.Errorf("no repeat %v: unexpected NAL units %v", noRepeat, count)
+		}
+	}
+
+	_, err := EncodeImage(image.NewRGBA(image.Rect(0, 0, 16, 16)), opts)
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected invalid input error, got %v", err)
+	}
+}
+
+func TestEncodeCQM(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		CQMPreset: CQMJVT,
+	}
+
+	custom := &QuantMatrices{}
+	for _, list := range [][]uint8{custom.Intra4x4Luma[:], custom.Inter4x4Luma[:], custom.Intra4x4Chroma[:], custom.Inter4x4Chroma[:],
+		custom.Intra8x8Luma[:], custom.Inter8x8Luma[:], custom.Intra8x8Chroma[:], custom.Inter8x8Chroma[:]} {
+		// symmetric, x264 transposes the matrices in place to match its DCT
+		n := 4
+		if len(list) == 64 {
+			n = 8
+		}
+		for i := range list {
+			list[i] = uint8(16 + i/n + i%n)
+		}
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for _, cqm := range []*QuantMatrices{nil, custom} {
+		o := *opts
+		o.CQM = cqm
+
+		enc, err := NewEncoder(ioutil.Discard, &o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		want := int32(x264c.CqmJvt)
+		if cqm != nil {
+			want = x264c.CqmCustom
+			if param.Cqm4iy != cqm.Intra4x4Luma || param.Cqm8py != cqm.Inter8x8Luma {
+				t.Errorf("custom matrices not applied")
+			}
+		}
+
+		if param.ICqmPreset != want {
+			t.Errorf("expected cqm preset %d, got %d", want, param.ICqmPreset)
+		}
+
+		for i := 0; i < 5; i++ {
+			if err = enc.Encode(img); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		changed := enc.Options()
+		changed.CQMPreset = CQMFlat
+		if err = enc.Reconfig(&changed); err == nil || !strings.Contains(err.Error(), "CQM") {
+			t.Errorf("expected CQM reconfig error, got %v", err)
+		}
+
+		if err = enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeOnKeyframe(t *testing.T) {
+	var pts []int64
+	var frames int
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		KeyintMax: 10,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnKeyframe: func(p int64) {
+			if p != int64(frames) {
+				t.Errorf("keyframe %d called after %d frames", p, frames)
+			}
+			pts = append(pts, p)
+		},
+		OnFrame: func(info FrameInfo, b []byte) {
+			frames++
+		},
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 30; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pts) != 3 || pts[0] != 0 || pts[1] != 10 || pts[2] != 20 {
+		t.Errorf("unexpected keyframes %v", pts)
+	}
+}
+
+func TestEncodeScheduleKeyframes(t *testing.T) {
+	var keyframes []int64
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnKeyframe: func(pts int64) {
+			keyframes = append(keyframes, pts)
+		},
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc.ScheduleKeyframes([]int64{7, 19})
+	enc.ScheduleKeyframes([]int64{13})
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 20; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keyframes) != 4 || keyframes[1] != 7 || keyframes[2] != 13 || keyframes[3] != 19 {
+		t.Errorf("unexpected keyframes %v", keyframes)
+	}
+
+	if len(enc.keyframes) != 0 {
+		t.Errorf("expected empty schedule, got %v", enc.keyframes)
+	}
+}
+
+func TestEncodeResourceStats(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		Threads:   2,
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ResourceStats{ImageBytes: 320 * 240 * 3 / 2, PlaneBytes: 320 * 240 * 3 / 2, Threads: 2, LookaheadThreads: 1}
+	if rs := enc.ResourceStats(); rs != want {
+		t.Errorf("expected %+v, got %+v", want, rs)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs := enc.ResourceStats(); rs.PlaneBytes != 0 || rs.Threads != 0 || rs.ImageBytes != want.ImageBytes {
+		t.Errorf("unexpected stats after close %+v", rs)
+	}
+
+	renc, r, err := NewReaderEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer renc.Close()
+
+	if rs := renc.ResourceStats(); rs.ReaderBytes != readerBufferSize {
+		t.Errorf("expected reader buffer of %d bytes, got %d", readerBufferSize, rs.ReaderBytes)
+	}
+}
+
+func TestEncodeNilWriter(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tee bytes.Buffer
+	enc.AddWriter(&tee)
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Reset(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Encode(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st := enc.Stats(); st.Frames != 1 || tee.Len() == 0 {
+		t.Errorf("unexpected %d frames, %d bytes written to the added writer", st.Frames, tee.Len())
+	}
+}
+
+func TestEncodeCFR(t *testing.T) {
+	var pts []int64
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Timebase:  1000,
+		CFR:       true,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnFrame: func(info FrameInfo, b []byte) {
+			pts = append(pts, info.PTS)
+		},
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	// 50 falls on frame 1 already encoded, 200 is frame 5 after a gap of two frames
+	for _, ms := range []int64{1000, 1040, 1050, 1080, 1200} {
+		err = enc.EncodeWithPTS(img, ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+	if len(pts) != 6 || pts[0] != 0 || pts[5] != 5 {
+		t.Errorf("unexpected output PTS %v", pts)
+	}
+
+	if st := enc.Stats(); st.Frames != 6 || st.FramesDropped != 1 || st.FramesRepeated != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestEncodeCFRRaw(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Timebase:      1000,
+		CFR:           true,
+		Tune:          "zerolatency",
+		Preset:        "veryfast",
+		Profile:       "high",
+		Deterministic: true,
+		Threads:       1,
+		LogLevel:      LogError,
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := range img.Y {
+		img.Y[i] = byte(i * 7919 >> 3)
+	}
+
+	raw := NewYCbCr(img.Rect)
+	for i := range raw.Y {
+		raw.Y[i] = byte(i * 6007 >> 2)
+	}
+
+	encode := func(useRaw bool) []byte {
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer enc.Close()
+
+		err = enc.EncodeWithPTS(img, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if useRaw {
+			err = enc.EncodeRaw(raw.Y, raw.Cb, raw.Cr, raw.YStride, raw.CStride)
+		} else {
+			err = enc.EncodeWithPTS(raw, 40)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// frames 2 and 3 repeat the second frame
+		err = enc.EncodeWithPTS(img, 160)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = enc.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st := enc.Stats(); st.Frames != 5 || st.FramesRepeated != 2 {
+			t.Errorf("raw %v: unexpected stats %+v", useRaw, st)
+		}
+
+		return buf.Bytes()
+	}
+
+	if !bytes.Equal(encode(true), encode(false)) {
+		t.Error("expected raw frame to be repeated like an image frame")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	if v := Version(); !strings.HasPrefix(v, fmt.Sprintf("0.%d", x264c.Build)) {
+		t.Errorf("unexpected version %q", v)
+	}
+
+	info := BuildInfo()
+	if !strings.HasPrefix(info, "x264 "+Version()) || !strings.Contains(info, "-bit") {
+		t.Errorf("unexpected build info %q", info)
+	}
+}
+
+func TestEncodeInvalidateReference(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		KeyintMax: 250,
+		RefFrames: 2,
+		DPBSize:   8,
+		Tune:      "zerolatency",
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	var keyframes []int64
+	opts.OnKeyframe = func(pts int64) {
+		keyframes = append(keyframes, pts)
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+	if param.IDpbSize != 8 {
+		t.Errorf("expected dpb size 8, got %d", param.IDpbSize)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			err = enc.InvalidateReference(5)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// frames before 5 are still in the DPB, no keyframe is needed
+	if len(keyframes) != 1 {
+		t.Errorf("unexpected keyframes %v", keyframes)
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = enc.InvalidateReference(0); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+
+	o := *opts
+	o.Tune = ""
+
+	enc, err = NewEncoder(nil, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	if err = enc.InvalidateReference(0); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected invalid input error with B-frames, got %v", err)
+	}
+}
+
+func TestEncodeAlphaWriter(t *testing.T) {
+	var alpha bytes.Buffer
+
+	opts := &Options{
+		Width:       320,
+		Height:      240,
+		FrameRate:   25,
+		Preset:      "veryfast",
+		Profile:     "main",
+		LogLevel:    LogError,
+		AlphaWriter: &alpha,
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := enc.alpha.Options().Profile; p != "high" {
+		t.Errorf("expected alpha stream in high profile, got %q", p)
+	}
+
+	sps, _, err := enc.alpha.Headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &bitReader{b: sps[4:]}
+	if r.ue(); r.ue() != 0 {
+		t.Errorf("expected monochrome alpha stream")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i / 4 % 200)
+	}
+
+	enc.ScheduleKeyframes([]int64{5})
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, a := range enc.alphaImg.Pix {
+		if a != img.Pix[4*i+3] {
+			t.Fatalf("alpha %d at %d, want %d", a, i, img.Pix[4*i+3])
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, ast := enc.Stats(), enc.alpha.Stats()
+	if st.Frames != 10 || ast.Frames != 10 || ast.FramesIDR != st.FramesIDR || alpha.Len() == 0 {
+		t.Errorf("unexpected streams, %+v and alpha %+v, %d bytes", st, ast, alpha.Len())
+	}
+}
+
+func TestEncodeChangeResolution(t *testing.T) {
+	var pts []int64
+
+	opts := &Options{
+		Width:        320,
+		Height:       240,
+		FrameRate:    25,
+		Preset:       "veryfast",
+		Profile:      "high",
+		LogLevel:     LogError,
+		DeferHeaders: true,
+		OnKeyframe: func(p int64) {
+			pts = append(pts, p)
+		},
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tee bytes.Buffer
+	enc.AddWriter(&tee)
+
+	err = enc.WriteHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []image.Point{{320, 240}, {640, 360}} {
+		if size.X != enc.Options().Width {
+			if err = enc.ChangeResolution(0, 360); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("expected invalid options error, got %v", err)
+			}
+
+			err = enc.ChangeResolution(size.X, size.Y)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = enc.Encode(NewYCbCr(image.Rect(0, 0, 320, 240))); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("expected invalid input error for the old size, got %v", err)
+			}
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, size.X, size.Y))
+		for i := 0; i < 5; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []image.Point
+	for _, part := range bytes.Split(buf.Bytes(), []byte{0, 0, 1}) {
+		if len(part) > 0 && int32(part[0]&0x1f) == NALSPS {
+			// SPS is also repeated with each keyframe
+			w, h := spsDisplaySize(part)
+			if len(sizes) == 0 || sizes[len(sizes)-1] != image.Pt(w, h) {
+				sizes = append(sizes, image.Pt(w, h))
+			}
+		}
+	}
+
+	if len(sizes) != 2 || sizes[0] != image.Pt(320, 240) || sizes[1] != image.Pt(640, 360) {
+		t.Errorf("unexpected SPS sizes %v", sizes)
+	}
+
+	if len(pts) != 2 || pts[1] != 5 || enc.Stats().Frames != 10 {
+		t.Errorf("unexpected keyframes %v, %d frames", pts, enc.Stats().Frames)
+	}
+
+	if !bytes.Equal(tee.Bytes(), buf.Bytes()) {
+		t.Errorf("added writer got %d bytes, want %d", tee.Len(), buf.Len())
+	}
+
+	if o := enc.Options(); o.Width != 640 || !o.DeferHeaders {
+		t.Errorf("unexpected options after change %+v", o)
+	}
+}
+
+func TestEncodeEntropy(t *testing.T) {
+	for _, tc := range []struct {
+		preset  string
+		entropy int32
+		cabac   int32
+	}{
+		{"veryfast", EntropyDefault, 1},
+		{"ultrafast", EntropyDefault, 0},
+		{"veryfast", EntropyCAVLC, 0},
+		{"ultrafast", EntropyCABAC, 1},
+	} {
+		opts := &Options{
+			Width:     320,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    tc.preset,
+			Profile:   "main",
+			LogLevel:  LogError,
+			Entropy:   tc.entropy,
+		}
+
+		enc, err := NewEncoder(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, pps, err := enc.Headers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// entropy_coding_mode_flag follows pic_parameter_set_id and seq_parameter_set_id
+		r := &bitReader{b: pps[1:]}
+		r.ue()
+		r.ue()
+		if cabac := int32(r.u(1)); cabac != tc.cabac {
+			t.Errorf("%s entropy %d: expected cabac %d, got %d", tc.preset, tc.entropy, tc.cabac, cabac)
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeOnEncodeTime(t *testing.T) {
+	var calls int
+	var total time.Duration
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnEncodeTime: func(d time.Duration) {
+			calls++
+			total += d
+		},
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delayed := enc.DelayedFrames()
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 10+delayed || total <= 0 {
+		t.Errorf("expected %d calls, got %d totaling %v", 10+delayed, calls, total)
+	}
+}
+
+// benchmarkFrames returns n synthetic frames with a moving gradient and some noise.
+func benchmarkFrames(w, h, n int) []*YCbCr {
+	frames := make([]*YCbCr, n)
+	seed := uint32(1)
+
+	for i := range frames {
+		img := NewYCbCr(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				seed = seed*1664525 + 1013904223
+				img.Y[y*img.YStride+x] = uint8(x+y+4*i) + uint8(seed>>28)
+			}
+		}
+		for j := range img.Cb {
+			img.Cb[j] = uint8(j/img.CStride + i)
+			img.Cr[j] = uint8(j%img.CStride - i)
+		}
+
+		frames[i] = img
+	}
+
+	return frames
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, size := range []image.Point{{640, 360}, {1280, 720}} {
+		frames := benchmarkFrames(size.X, size.Y, 25)
+
+		for _, preset := range []string{"ultrafast", "veryfast", "medium"} {
+			b.Run(fmt.Sprintf("%s/%dx%d", preset, size.X, size.Y), func(b *testing.B) {
+				var spent time.Duration
+
+				opts := &Options{
+					Width:     size.X,
+					Height:    size.Y,
+					FrameRate: 25,
+					Preset:    preset,
+					Profile:   "high",
+					LogLevel:  LogError,
+					OnEncodeTime: func(d time.Duration) {
+						spent += d
+					},
+				}
+
+				enc, err := NewEncoder(nil, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.SetBytes(int64(size.X * size.Y * 3 / 2))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					err = enc.Encode(frames[i%len(frames)])
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StopTimer()
+				b.ReportMetric(float64(spent.Nanoseconds())/float64(b.N), "x264-ns/op")
+
+				err = enc.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodePlanes(t *testing.T) {
+	for _, cs := range []int32{ColorSpaceI420, ColorSpaceNV12, ColorSpaceI400} {
+		var pts []int64
+
+		opts := &Options{
+			Width:      320,
+			Height:     240,
+			FrameRate:  25,
+			Preset:     "veryfast",
+			Profile:    "high",
+			ColorSpace: cs,
+			LogLevel:   LogError,
+			OnFrame: func(info FrameInfo, b []byte) {
+				pts = append(pts, info.PTS)
+			},
+		}
+
+		enc, err := NewEncoder(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+		in := PlaneInput{Y: img.Y, Cb: img.Cb, Cr: img.Cr, StrideY: img.YStride, StrideC: img.CStride}
+		if cs == ColorSpaceNV12 {
+			in.Cb, in.Cr, in.StrideC = append(img.Cb, img.Cr...), nil, 2*img.CStride
+		}
+
+		short := in
+		short.Y = short.Y[:len(short.Y)-1]
+		if err = enc.EncodePlanes(short); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("colorspace %d: expected invalid input error, got %v", cs, err)
+		}
+
+		for i := 0; i < 5; i++ {
+			in.PTS = int64(2 * i)
+			err = enc.EncodePlanes(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+		if len(pts) != 5 || pts[4] != 8 {
+			t.Errorf("colorspace %d: unexpected PTS %v", cs, pts)
+		}
+
+		if err = enc.EncodePlanes(in); !errors.Is(err, ErrClosed) {
+			t.Errorf("colorspace %d: expected closed error, got %v", cs, err)
+		}
+	}
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	parent := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for i := range parent.Pix {
+		parent.Pix[i] = uint8(i * 7 % 251)
+	}
+
+	r := image.Rect(100, 50, 420, 290)
+	flat := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(flat, flat.Rect, parent, r.Min, draw.Src)
+
+	parentYCbCr := NewYCbCr(parent.Rect)
+	parentYCbCr.ToYCbCr(parent)
+	flatYCbCr := NewYCbCr(flat.Rect)
+	flatYCbCr.ToYCbCr(flat)
+
+	nrgba := &image.NRGBA{Pix: parent.Pix, Stride: parent.Stride, Rect: parent.Rect}
+	flatNRGBA := &image.NRGBA{Pix: flat.Pix, Stride: flat.Stride, Rect: flat.Rect}
+
+	for _, tc := range []struct {
+		name      string
+		sub, want image.Image
+	}{
+		{"rgba", parent.SubImage(r), flat},
+		{"nrgba", nrgba.SubImage(r), flatNRGBA},
+		{"ycbcr", parentYCbCr.SubImage(r), flatYCbCr},
+	} {
+		planes := func(im image.Image) [][]byte {
+			enc, err := NewEncoder(nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer enc.Close()
+
+			err = enc.Encode(im)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return [][]byte{enc.img.Y[:enc.img.YStride*opts.Height], enc.img.Cb, enc.img.Cr}
+		}
+
+		got, want := planes(tc.sub), planes(tc.want)
+		for i := range got {
+			for j := range got[i] {
+				if d := int(got[i][j]) - int(want[i][j]); d < -2 || d > 2 {
+					t.Fatalf("%s: plane %d sample %d is %d, want %d", tc.name, i, j, got[i][j], want[i][j])
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeWarmup(t *testing.T) {
+	var frames int
+
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		OnFrame: func(info FrameInfo, b []byte) {
+			frames++
+		},
+	}
+
+	stream := func(warmup bool) []byte {
+		enc, buf, err := NewBufferEncoder(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := buf.Len()
+		if warmup {
+			err = enc.Warmup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if frames != 0 || enc.Stats().Frames != 0 || buf.Len() != size {
+				t.Fatalf("Warmup reported %d frames, stats %d, wrote %d bytes", frames, enc.Stats().Frames, buf.Len()-size)
+			}
+
+			for i, p := range enc.cplanes[:3] {
+				if b := cslice(p, enc.cplanesLen[i]); b[0] != 0x80 || b[len(b)-1] != 0x80 {
+					t.Errorf("plane %d not touched by Warmup", i)
+				}
+			}
+		}
+
+		enc.ForceKeyframe()
+		for i := 0; i < 10; i++ {
+			img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+			for j := range img.Pix {
+				img.Pix[j] = uint8(j*3 + i*5)
+			}
+
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Warmup()
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Fatalf("Warmup after the first frame returned %v", err)
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+	}
+
+	want := stream(false)
+	frames = 0
+
+	got := stream(true)
+	if frames != 10 {
+		t.Errorf("got %d frames, want 10", frames)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("stream after Warmup differs, %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestEncodeNoMBTree(t *testing.T) {
+	for _, noMBTree := range []bool{false, true} {
+		opts := &Options{
+			Width:     320,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    "veryfast",
+			Profile:   "high",
+			LogLevel:  LogError,
+			NoMBTree:  noMBTree,
+		}
+
+		enc, err := NewEncoder(ioutil.Discard, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var param x264c.Param
+		x264c.EncoderParameters(enc.e, &param)
+
+		if got := param.Rc.BMbTree == 0; got != noMBTree {
+			t.Errorf("NoMBTree %v: got mbtree %d", noMBTree, param.Rc.BMbTree)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeEffectiveParams(t *testing.T) {
+	opts := &Options{
+		Width:         320,
+		Height:        240,
+		FrameRate:     25,
+		Preset:        "veryfast",
+		Profile:       "baseline",
+		RateControl:   RateControlABR,
+		Bitrate:       800,
+		VBVMaxRate:    800,
+		VBVBufferSize: 400,
+		KeyintMax:     50,
+		ColorSpace:    ColorSpaceNV12,
+		LogLevel:      LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := enc.EffectiveParams()
+	enc.Close()
+
+	if p.Width != 320 || p.Height != 240 || p.ColorSpace != ColorSpaceNV12 || p.BitDepth != 8 {
+		t.Errorf("got size %dx%d, color space %d, bit depth %d", p.Width, p.Height, p.ColorSpace, p.BitDepth)
+	}
+
+	// baseline profile disables B-frames and CABAC
+	if p.KeyintMax != 50 || p.BFrames != 0 || p.CABAC {
+		t.Errorf("got keyint %d, %d B-frames, CABAC %v", p.KeyintMax, p.BFrames, p.CABAC)
+	}
+
+	if p.RateControl != RateControlABR || p.Bitrate != 800 || p.VBVMaxRate != 800 || p.VBVBufferSize != 400 {
+		t.Errorf("got rate control %d, bitrate %d, VBV %d/%d", p.RateControl, p.Bitrate, p.VBVMaxRate, p.VBVBufferSize)
+	}
+
+	if p.Level == "" || p.Threads < 1 {
+		t.Errorf("got level %q, %d threads", p.Level, p.Threads)
+	}
+
+	if p = enc.EffectiveParams(); p != (EffectiveParams{}) {
+		t.Errorf("closed encoder returned %+v", p)
+	}
+}
+
+func TestEncodeFrameBuffered(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+
+	// the lookahead buffers the first frames
+	b, info, err := enc.EncodeFrameInfo(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b != nil || info != (FrameInfo{Buffered: true}) {
+		t.Fatalf("first frame returned %d bytes, info %+v", len(b), info)
+	}
+
+	if enc.LastFrameSize() != 0 || enc.DelayedFrames() == 0 {
+		t.Errorf("got last frame size %d, %d delayed frames", enc.LastFrameSize(), enc.DelayedFrames())
+	}
+
+	var frames int
+	for i := 0; i < 50; i++ {
+		b, info, err = enc.EncodeFrameInfo(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Buffered != (b == nil) || (b != nil && len(b) == 0) {
+			t.Fatalf("frame %d: %d bytes, buffered %v", i, len(b), info.Buffered)
+		}
+
+		if b != nil {
+			frames++
+		}
+	}
+
+	for enc.DelayedFrames() > 0 {
+		b, info, err = enc.EncodeFrameInfo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b != nil {
+			frames++
+		}
+	}
+
+	if frames != 51 {
+		t.Errorf("got %d frames, want 51", frames)
+	}
+}
+
+func TestEncodeBytesWritten(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.BytesWritten() != int64(buf.Len()) || enc.BytesWritten() == 0 {
+		t.Errorf("headers: got %d bytes written, buffer holds %d", enc.BytesWritten(), buf.Len())
+	}
+
+	// a failing added writer is dropped without changing what is counted for the writer
+	enc.AddWriter(errWriter{})
+	failed := 0
+
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for i := 0; i < 20; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			failed++
+		}
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		failed++
+	}
+
+	if failed != 1 {
+		t.Errorf("expected one added writer error, got %d", failed)
+	}
+
+	if enc.BytesWritten() != int64(buf.Len()) || enc.FramesEncoded() != 20 {
+		t.Errorf("got %d bytes written, %d frames, buffer holds %d", enc.BytesWritten(), enc.FramesEncoded(), buf.Len())
+	}
+
+	err = enc.Reset(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.FramesEncoded() != 0 || enc.BytesWritten() == 0 || enc.BytesWritten() >= int64(buf.Len()) {
+		t.Errorf("after Reset: got %d bytes written, %d frames", enc.BytesWritten(), enc.FramesEncoded())
+	}
+
+	written := enc.BytesWritten()
+	for i := 0; i < 20; i++ {
+		_, err = enc.EncodeFrame(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if enc.Stats().Frames == 0 || enc.FramesEncoded() != 0 || enc.BytesWritten() != written {
+		t.Errorf("EncodeFrame: got %d bytes written, %d frames, stats %d frames", enc.BytesWritten(), enc.FramesEncoded(), enc.Stats().Frames)
+	}
+
+	enc.Close()
+}
+
+func TestEncodeChannel(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+
+	frames := make(chan image.Image)
+	done := make(chan error, 1)
+	go func() {
+		done <- enc.EncodeChannel(context.Background(), frames)
+	}()
+
+	for i := 0; i < 30; i++ {
+		frames <- img
+	}
+	close(frames)
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if enc.Stats().Frames != 30 || enc.DelayedFrames() != 0 {
+		t.Errorf("got %d frames, %d delayed", enc.Stats().Frames, enc.DelayedFrames())
+	}
+
+	// x264 takes no frames after a flush
+	enc, err = NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	frames = make(chan image.Image)
+	go func() {
+		done <- enc.EncodeChannel(ctx, frames)
+	}()
+
+	frames <- img
+	cancel()
+
+	if err = <-done; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	frames = make(chan image.Image, 1)
+	frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+
+	err = enc.EncodeChannel(context.Background(), frames)
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestEncodeDisablePsy(t *testing.T) {
+	opts := &Options{
+		Width:      320,
+		Height:     240,
+		FrameRate:  25,
+		Tune:       "film",
+		Preset:     "medium",
+		Profile:    "high",
+		LogLevel:   LogError,
+		DisablePsy: true,
+	}
+
+	enc, err := NewEncoder(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.Analyse.BPsy != 0 || param.Analyse.FPsyRd != 0 || param.Analyse.FPsyTrellis != 0 {
+		t.Errorf("unexpected psy params psy=%d rd=%v trellis=%v", param.Analyse.BPsy, param.Analyse.FPsyRd, param.Analyse.FPsyTrellis)
+	}
+
+	// AQ is kept, unlike with the psnr tune
+	if param.Rc.IAqMode == x264c.AqNone {
+		t.Errorf("AQ disabled")
+	}
+}
+
+func TestEncodeRawStrides(t *testing.T) {
+	const w, h = 320, 240
+
+	for _, cs := range []int32{ColorSpaceI420, ColorSpaceNV12} {
+		opts := &Options{
+			Width:      w,
+			Height:     h,
+			FrameRate:  25,
+			Preset:     "veryfast",
+			Profile:    "high",
+			ColorSpace: cs,
+			LogLevel:   LogError,
+		}
+
+		cw := w / 2
+		if cs == ColorSpaceNV12 {
+			cw = w
+		}
+
+		// packed planes, chroma planes are the same size for NV12 where only cb is used
+		y := make([]byte, w*h)
+		cb := make([]byte, cw*h/2)
+		cr := make([]byte, cw*h/2)
+		for i := range y {
+			y[i] = uint8(i % 251)
+		}
+		for i := range cb {
+			cb[i], cr[i] = uint8(i%97+64), uint8(i%89+80)
+		}
+
+		// one buffer with aligned luma and differently padded chroma rows
+		strideY, strideCb, strideCr := 384, cw+32, cw+64
+		buf := make([]byte, strideY*h+strideCb*(h/2)+strideCr*(h/2))
+		padY, padCb, padCr := buf[:strideY*h], buf[strideY*h:strideY*h+strideCb*(h/2)], buf[strideY*h+strideCb*(h/2):]
+		for r := 0; r < h; r++ {
+			copy(padY[r*strideY:], y[r*w:(r+1)*w])
+		}
+		for r := 0; r < h/2; r++ {
+			copy(padCb[r*strideCb:], cb[r*cw:(r+1)*cw])
+			copy(padCr[r*strideCr:], cr[r*cw:(r+1)*cw])
+		}
+
+		encode := func(padded bool) []byte {
+			enc, out, err := NewBufferEncoder(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 5; i++ {
+				switch {
+				case padded:
+					err = enc.EncodeRawStrides(padY, padCb, padCr, strideY, strideCb, strideCr)
+				case cs == ColorSpaceNV12:
+					err = enc.EncodeNV12(y, cb)
+				default:
+					err = enc.EncodeRaw(y, cb, cr, w, cw)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = enc.EncodeRawStrides(padY, padCb, padCr, strideY, cw-1, strideCr)
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("color space %d: short stride returned %v", cs, err)
+			}
+
+			err = enc.EncodeRawStrides(padY, padCb[:strideCb*(h/2-1)], padCr, strideY, strideCb, strideCr)
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("color space %d: short plane returned %v", cs, err)
+			}
+
+			err = enc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return out.Bytes()
+		}
+
+		if !bytes.Equal(encode(true), encode(false)) {
+			t.Errorf("color space %d: padded planes encoded differently", cs)
+		}
+	}
+}
+
+func TestEncodeAUD(t *testing.T) {
+	for _, tc := range []struct {
+		format int32
+		aud    bool
+	}{
+		{NALFormatAnnexB, true},
+		{NALFormatAVCC, true},
+		{NALFormatAnnexB, false},
+	} {
+		var frames [][]byte
+
+		opts := &Options{
+			Width:     320,
+			Height:    240,
+			FrameRate: 25,
+			Preset:    "veryfast",
+			Profile:   "high",
+			LogLevel:  LogError,
+			NALFormat: tc.format,
+			AUD:       tc.aud,
+			OnFrame: func(info FrameInfo, b []byte) {
+				frames = append(frames, b)
+			},
+		}
+
+		enc, err := NewEncoder(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+		for i := 0; i < 10; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(frames) != 10 {
+			t.Fatalf("got %d frames, want 10", len(frames))
+		}
+
+		for i, b := range frames {
+			// 4 byte start code or length prefix
+			if len(b) < 5 {
+				t.Fatalf("format %d: frame %d of %d bytes", tc.format, i, len(b))
+			}
+
+			if tc.format == NALFormatAnnexB && !bytes.HasPrefix(b, []byte{0, 0, 0, 1}) {
+				t.Fatalf("frame %d: missing start code %x", i, b[:4])
+			}
+
+			if aud := int32(b[4]&0x1f) == NALAUD; aud != tc.aud {
+				t.Errorf("format %d, AUD %v: frame %d starts with NAL type %d", tc.format, tc.aud, i, b[4]&0x1f)
+			}
+		}
+	}
+}
+
+func TestEncodeChangeResolutionAlpha(t *testing.T) {
+	var alpha bytes.Buffer
+
+	opts := &Options{
+		Width:       320,
+		Height:      240,
+		FrameRate:   25,
+		Preset:      "veryfast",
+		Profile:     "high",
+		LogLevel:    LogError,
+		AlphaWriter: &alpha,
+	}
+
+	enc, _, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []image.Point{{320, 240}, {640, 360}} {
+		if size.X != enc.Options().Width {
+			err = enc.ChangeResolution(size.X, size.Y)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		for i := 0; i < 5; i++ {
+			err = enc.Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = enc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []image.Point
+	for _, part := range bytes.Split(alpha.Bytes(), []byte{0, 0, 1}) {
+		if len(part) > 0 && int32(part[0]&0x1f) == NALSPS {
+			w, h := spsDisplaySize(part)
+			if len(sizes) == 0 || sizes[len(sizes)-1] != image.Pt(w, h) {
+				sizes = append(sizes, image.Pt(w, h))
+			}
+		}
+	}
+
+	if len(sizes) != 2 || sizes[1] != image.Pt(640, 360) || enc.alpha.Stats().Frames != 10 {
+		t.Errorf("unexpected alpha SPS sizes %v, %d frames", sizes, enc.alpha.Stats().Frames)
+	}
+}
+
+func TestEncodeTelemetryVFR(t *testing.T) {
+	var snaps []TelemetrySnapshot
+	var sizes []int
+
+	opts := &Options{
+		Width:             320,
+		Height:            240,
+		FrameRate:         25,
+		Tune:              "zerolatency",
+		Preset:            "veryfast",
+		Profile:           "high",
+		LogLevel:          LogError,
+		VFR:               true,
+		Timebase:          1000,
+		TelemetryInterval: 10,
+		OnFrame: func(info FrameInfo, b []byte) {
+			sizes = append(sizes, len(b))
+		},
+		Telemetry: func(s TelemetrySnapshot) {
+			snaps = append(snaps, s)
+		},
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	// 12.5 fps input, half the nominal FrameRate
+	for i := 0; i < 30; i++ {
+		for j := range img.Y {
+			img.Y[j] = uint8(j*(i+1) + j*j/5)
+		}
+
+		err = enc.EncodeWithPTS(img, int64(i)*80)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snaps) != 3 || len(sizes) != 30 {
+		t.Fatalf("expected 3 snapshots of 30 frames, got %d of %d", len(snaps), len(sizes))
+	}
+
+	for i, s := range snaps {
+		var n int
+		for _, size := range sizes[10*i : 10*i+10] {
+			n += size
+		}
+
+		// 10 frames of 80 ms
+		want := float64(n) * 8 / 0.8 / 1000
+		if math.Abs(s.Bitrate-want) > 0.01*want {
+			t.Errorf("snapshot %d: bitrate %.1f kbps, want %.1f", i, s.Bitrate, want)
+		}
+	}
+
+	// 30 frames of 80 ms
+	st := enc.Stats()
+	if want := float64(st.Bytes) * 8 / 2.4 / 1000; math.Abs(st.Bitrate-want) > 0.01*want {
+		t.Errorf("stats bitrate %.1f kbps, want %.1f", st.Bitrate, want)
+	}
+}
+
+func TestEncodeResizeEmpty(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		LogLevel:  LogError,
+		Resize:    true,
+	}
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 320, 0), image.Rect(5, 5, 5, 100)} {
+		err = enc.Encode(image.NewRGBA(r))
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("%v: expected ErrInvalidInput, got %v", r, err)
+		}
+	}
+}
+
+func TestEncodeWithQuantOffsetsNoAQ(t *testing.T) {
+	for _, o := range []Options{{AQMode: AQModeNone, NoMBTree: true}, {RateControl: RateControlCQP, QP: 26}} {
+		opts := &Options{
+			Width:       320,
+			Height:      240,
+			FrameRate:   25,
+			Preset:      "veryfast",
+			Profile:     "high",
+			LogLevel:    LogError,
+			AQMode:      o.AQMode,
+			NoMBTree:    o.NoMBTree,
+			RateControl: o.RateControl,
+			QP:          o.QP,
+		}
+
+		enc, err := NewEncoder(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+		err = enc.EncodeWithQuantOffsets(img, make([]float32, 20*15))
+		if !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("AQ mode %d, rate control %d: expected ErrInvalidInput, got %v", o.AQMode, o.RateControl, err)
+		}
+
+		enc.Close()
+	}
+}
+
+func TestEncodeWithQuantOffsetsInterlaced(t *testing.T) {
+	opts := &Options{
+		Width:      320,
+		Height:     240,
+		FrameRate:  25,
+		Preset:     "veryfast",
+		Profile:    "high",
+		LogLevel:   LogError,
+		Interlaced: true,
+	}
+
+	enc, buf, err := NewBufferEncoder(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer enc.Close()
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	// 15 macroblock rows are coded as 16
+	err = enc.EncodeWithQuantOffsets(img, make([]float32, 20*15))
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("expected ErrInvalidInput for progressive length, got %v", err)
+	}
+
+	err = enc.EncodeWithQuantOffsets(img, make([]float32, 20*16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() == 0 {
+		t.Error("expected output")
+	}
+}
+
+func TestEncodeAlphaRGB24NV21(t *testing.T) {
+	for _, name := range []string{"rgb24", "nv21"} {
+		var alpha bytes.Buffer
+
+		opts := &Options{
+			Width:       320,
+			Height:      240,
+			FrameRate:   25,
+			Preset:      "veryfast",
+			Profile:     "high",
+			LogLevel:    LogError,
+			AlphaWriter: &alpha,
+		}
+
+		enc, err := NewEncoder(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range []image.Point{{320, 240}, {640, 360}} {
+			if size.X != enc.Options().Width {
+				err = enc.ChangeResolution(size.X, size.Y)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w, h := size.X, size.Y
+			for i := 0; i < 3; i++ {
+				if name == "rgb24" {
+					err = enc.EncodeRGB24(make([]byte, 3*w*h), 3*w)
+				} else {
+					err = enc.EncodeNV21(make([]byte, w*h), make([]byte, w*h/2))
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}
+
+			if enc.alphaImg.Rect.Size() != size {
+				t.Errorf("%s: alpha plane %v, want %v", name, enc.alphaImg.Rect.Size(), size)
+			}
+
+			for i, a := range enc.alphaImg.Pix {
+				if a != 255 {
+					t.Fatalf("%s: alpha %d at %d, want opaque", name, a, i)
+				}
+			}
+		}
+
+		err = enc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enc.alpha.Stats().Frames != 6 || alpha.Len() == 0 {
+			t.Errorf("%s: unexpected alpha stream, %d frames, %d bytes", name, enc.alpha.Stats().Frames, alpha.Len())
+		}
+	}
+}
+
+func TestEncodeLevels(t *testing.T) {
+	c := color.NRGBA{255, 200, 50, 255}
+	wy, wcb, wcr := RGBToYCbCrBT601(c.R, c.G, c.B)
+
+	for _, size := range []image.Point{{320, 240}, {321, 241}} {
+		for _, cs := range []int32{ColorSpaceI420, ColorSpaceI422, ColorSpaceI444} {
+			opts := &Options{
+				Width:      size.X,
+				Height:     size.Y,
+				FrameRate:  25,
+				Preset:     "veryfast",
+				Profile:    "high444",
+				LogLevel:   LogError,
+				ColorSpace: cs,
+			}
+
+			enc, err := NewEncoder(ioutil.Discard, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rgba := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+			nrgba := image.NewNRGBA(rgba.Rect)
+			draw.Draw(rgba, rgba.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+			draw.Draw(nrgba, nrgba.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+
+			for _, img := range []image.Image{rgba, nrgba} {
+				err = enc.Encode(img)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the 4:2:0 fast path rounds chroma differently
+				last := enc.img.YOffset(size.X-1, size.Y-1)
+				d := absDiff(enc.img.Y[0], wy) + absDiff(enc.img.Y[last], wy) + absDiff(enc.img.Cb[0], wcb) + absDiff(enc.img.Cr[0], wcr)
+				if d > 1 {
+					t.Errorf("%v color space %d %T: got %d,%d,%d, want %d,%d,%d", size, cs, img,
+						enc.img.Y[0], enc.img.Cb[0], enc.img.Cr[0], wy, wcb, wcr)
+				}
+			}
+
+			enc.Close()
+		}
+	}
+}
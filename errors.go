@@ -0,0 +1,54 @@
+package x264
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds, returned errors match them with errors.Is.
+var (
+	// ErrInvalidOptions is matched by errors of invalid or conflicting Options fields.
+	ErrInvalidOptions = errors.New("x264: invalid options")
+	// ErrInvalidPreset is matched by errors of unknown Preset, Tune or Profile names, they also match ErrInvalidOptions.
+	ErrInvalidPreset error = &kindError{kind: ErrInvalidOptions, msg: "x264: invalid preset, tune or profile"}
+	// ErrInvalidInput is matched by errors of images, planes or per-frame arguments that do not fit the encoder.
+	ErrInvalidInput = errors.New("x264: invalid input")
+	// ErrEncoderOpen is matched by errors of x264 refusing to open the encoder.
+	ErrEncoderOpen = errors.New("x264: cannot open the encoder")
+	// ErrEncode is matched by errors of x264 failing to encode or reconfigure.
+	ErrEncode = errors.New("x264: encoding failed")
+	// ErrWrite is matched by errors of the writers, which unwrap to the writer error.
+	ErrWrite = errors.New("x264: write failed")
+	// ErrClosed is returned by calls on a closed encoder.
+	ErrClosed = errors.New("x264: encoder is closed")
+)
+
+// kindError is an error with its own message that matches kind and wraps an optional cause.
+type kindError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+// Is reports whether target is the kind of e, or a kind it belongs to.
+func (e *kindError) Is(target error) bool {
+	return target == e.kind || errors.Is(e.kind, target)
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// errorf returns error of the given kind formatted like fmt.Errorf.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// writeError wraps writer error err.
+func writeError(err error) error {
+	return &kindError{kind: ErrWrite, msg: "x264: write failed: " + err.Error(), err: err}
+}
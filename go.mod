@@ -3,6 +3,6 @@ module github.com/samespace/x264-go
 go 1.16
 
 require (
-	github.com/samespace/x264-go/x264c v0.0.0-20220602123831-15558fdc9e57
-	github.com/samespace/x264-go/yuv v0.0.0-20220602123831-15558fdc9e57
+	github.com/samespace/x264-go/x264c v0.1.0
+	github.com/samespace/x264-go/yuv v0.1.0
 )
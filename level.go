@@ -0,0 +1,143 @@
+package x264
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+// level represents H.264 level limits (Table A-1).
+type level struct {
+	// level_idc value
+	idc int
+	// max macroblock processing rate (macroblocks/sec)
+	mbps int
+	// max frame size (macroblocks)
+	frameSize int
+	// max bitrate (kbit/sec)
+	bitrate int
+	// max vbv buffer (kbit)
+	cpb int
+}
+
+var levels = []level{
+	{10, 1485, 99, 64, 175},
+	{9, 1485, 99, 128, 350},
+	{11, 3000, 396, 192, 500},
+	{12, 6000, 396, 384, 1000},
+	{13, 11880, 396, 768, 2000},
+	{20, 11880, 396, 2000, 2000},
+	{21, 19800, 792, 4000, 4000},
+	{22, 20250, 1620, 4000, 4000},
+	{30, 40500, 1620, 10000, 10000},
+	{31, 108000, 3600, 14000, 14000},
+	{32, 216000, 5120, 20000, 20000},
+	{40, 245760, 8192, 20000, 25000},
+	{41, 245760, 8192, 50000, 62500},
+	{42, 522240, 8704, 50000, 62500},
+	{50, 589824, 22080, 135000, 135000},
+	{51, 983040, 36864, 240000, 240000},
+	{52, 2073600, 36864, 240000, 240000},
+	{60, 4177920, 139264, 240000, 240000},
+	{61, 8355840, 139264, 480000, 480000},
+	{62, 16711680, 139264, 800000, 800000},
+}
+
+// findLevel returns limits of level name, i.e. "1b", "3", "4.1".
+func findLevel(name string) (l level, ok bool) {
+	idc := 9
+	if name != "1b" {
+		major, minor := name, "0"
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			major, minor = name[:i], name[i+1:]
+		}
+
+		a, err := strconv.Atoi(major)
+		if err != nil || len(minor) != 1 {
+			return
+		}
+
+		b, err := strconv.Atoi(minor)
+		if err != nil {
+			return
+		}
+
+		idc = a*10 + b
+	}
+
+	for _, l = range levels {
+		if l.idc == idc {
+			ok = true
+			return
+		}
+	}
+
+	return
+}
+
+// levelName returns level name of level_idc value.
+func levelName(idc int) string {
+	if idc == 9 {
+		return "1b"
+	}
+
+	return fmt.Sprintf("%d.%d", idc/10, idc%10)
+}
+
+// checkLevel checks that options fit into the limits of level l.
+func (o *Options) checkLevel(l level) error {
+	w, h := o.Width, o.Height
+	if o.ColorSpace == ColorSpaceI420 || o.ColorSpace == ColorSpaceNV12 {
+		w, h = w+w%2, h+h%2
+	}
+
+	mbw, mbh := (w+15)/16, (h+15)/16
+	mbs := mbw * mbh
+
+	if mbs > l.frameSize || mbw*mbw > 8*l.frameSize || mbh*mbh > 8*l.frameSize {
+		return errorf(ErrInvalidOptions, "x264: invalid Level %q, frame size %dx%d MBs exceeds level limit %d", o.Level, mbw, mbh, l.frameSize)
+	}
+
+	if rate := mbs * o.FrameRate; rate > l.mbps {
+		return errorf(ErrInvalidOptions, "x264: invalid Level %q, MB rate %d exceeds level limit %d", o.Level, rate, l.mbps)
+	}
+
+	// High profiles allow higher bitrates
+	factor := 4
+	switch o.Profile {
+	case "high":
+		factor = 5
+	case "high10":
+		factor = 12
+	case "high422", "high444":
+		factor = 16
+	}
+
+	if limit := l.bitrate * factor / 4; o.RateControl == RateControlABR && o.Bitrate > limit {
+		return errorf(ErrInvalidOptions, "x264: invalid Level %q, bitrate %d exceeds level limit %d", o.Level, o.Bitrate, limit)
+	}
+
+	if limit := l.bitrate * factor / 4; o.VBVMaxRate > limit {
+		return errorf(ErrInvalidOptions, "x264: invalid Level %q, VBV bitrate %d exceeds level limit %d", o.Level, o.VBVMaxRate, limit)
+	}
+
+	if limit := l.cpb * factor / 4; o.VBVBufferSize > limit {
+		return errorf(ErrInvalidOptions, "x264: invalid Level %q, VBV buffer %d exceeds level limit %d", o.Level, o.VBVBufferSize, limit)
+	}
+
+	return nil
+}
+
+// Level returns H.264 level of the stream, the requested Level or the one selected by x264.
+func (e *Encoder) Level() string {
+	if e.e == nil {
+		return ""
+	}
+
+	var param x264c.Param
+	x264c.EncoderParameters(e.e, &param)
+
+	return levelName(int(param.ILevelIdc))
+}
@@ -0,0 +1,12 @@
+#include <stdarg.h>
+#include <stdio.h>
+
+#include "_cgo_export.h"
+
+// x264goLog formats x264 log lines and passes them to the Go logger registered under priv.
+void x264goLog(void *priv, int level, const char *fmt, va_list args) {
+	char buf[1024];
+
+	vsnprintf(buf, sizeof(buf), fmt, args);
+	x264goLogMessage(*(int *)priv, level, buf);
+}
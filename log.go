@@ -0,0 +1,64 @@
+package x264
+
+/*
+#include <stdarg.h>
+#include <stdlib.h>
+
+void x264goLog(void *priv, int level, const char *fmt, va_list args);
+*/
+import "C"
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+// loggers maps ids passed to x264 as log private data to Options.Logger functions.
+var (
+	loggersMu sync.Mutex
+	loggers   = make(map[C.int]func(level int, msg string))
+	loggersID C.int
+)
+
+//export x264goLogMessage
+func x264goLogMessage(id C.int, level C.int, msg *C.char) {
+	loggersMu.Lock()
+	fn := loggers[id]
+	loggersMu.Unlock()
+
+	if fn != nil {
+		fn(int(level), strings.TrimRight(C.GoString(msg), "\n"))
+	}
+}
+
+// setLogger registers Options.Logger and installs it as the log callback of param.
+func (e *Encoder) setLogger(param *x264c.Param) {
+	loggersMu.Lock()
+	loggersID++
+	id := loggersID
+	loggers[id] = e.opts.Logger
+	loggersMu.Unlock()
+
+	e.logID = (*C.int)(C.malloc(C.size_t(unsafe.Sizeof(id))))
+	*e.logID = id
+
+	param.PfLog = (*[0]byte)(C.x264goLog)
+	param.PLogPrivate = unsafe.Pointer(e.logID)
+}
+
+// freeLogger unregisters the logger, x264 must not log afterwards.
+func (e *Encoder) freeLogger() {
+	if e.logID == nil {
+		return
+	}
+
+	loggersMu.Lock()
+	delete(loggers, *e.logID)
+	loggersMu.Unlock()
+
+	C.free(unsafe.Pointer(e.logID))
+	e.logID = nil
+}
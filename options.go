@@ -0,0 +1,478 @@
+package x264
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+var (
+	presets  = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+	tunes    = []string{"film", "animation", "grain", "stillimage", "psnr", "ssim", "fastdecode", "zerolatency"}
+	profiles = []string{"baseline", "main", "high", "high10", "high422", "high444"}
+
+	colorPrimaries = []string{"bt709", "undef", "bt470m", "bt470bg", "smpte170m", "smpte240m", "film", "bt2020", "smpte428", "smpte431", "smpte432"}
+	transfers      = []string{"bt709", "undef", "bt470m", "bt470bg", "smpte170m", "smpte240m", "linear", "log100", "log316", "iec61966-2-4",
+		"bt1361e", "iec61966-2-1", "bt2020-10", "bt2020-12", "smpte2084", "smpte428", "arib-std-b67"}
+	colorMatrices = []string{"GBR", "bt709", "undef", "fcc", "bt470bg", "smpte170m", "smpte240m", "YCgCo", "bt2020nc", "bt2020c",
+		"smpte2085", "chroma-derived-nc", "chroma-derived-c", "ICtCp"}
+)
+
+// ValidPresets returns the accepted Preset names, from fastest to slowest.
+func ValidPresets() []string {
+	return append([]string(nil), presets...)
+}
+
+// ValidTunes returns the accepted Tune names.
+func ValidTunes() []string {
+	return append([]string(nil), tunes...)
+}
+
+// ValidProfiles returns the accepted Profile names.
+func ValidProfiles() []string {
+	return append([]string(nil), profiles...)
+}
+
+// CheckPreset checks preset and tune names as Validate does, without opening an encoder. Empty names are valid.
+func CheckPreset(preset, tune string) error {
+	if preset != "" && !contains(presets, preset) {
+		return errorf(ErrInvalidPreset, "x264: invalid Preset %q", preset)
+	}
+
+	for _, t := range splitTune(tune) {
+		if !contains(tunes, t) {
+			return errorf(ErrInvalidPreset, "x264: invalid Tune %q", t)
+		}
+	}
+
+	return nil
+}
+
+// StreamingOptions returns options for live streaming at a constant bitrate in kbps: zerolatency tuning,
+// a VBV buffer of one second at the target bitrate, and a keyframe every two seconds.
+// Fields can be adjusted before passing the options to NewEncoder.
+func StreamingOptions(width, height, fps, bitrateKbps int) *Options {
+	return &Options{
+		Width:         width,
+		Height:        height,
+		FrameRate:     fps,
+		Preset:        "veryfast",
+		Tune:          "zerolatency",
+		Profile:       "main",
+		LogLevel:      LogError,
+		RateControl:   RateControlABR,
+		Bitrate:       bitrateKbps,
+		VBVMaxRate:    bitrateKbps,
+		VBVBufferSize: bitrateKbps,
+		KeyintMax:     2 * fps,
+	}
+}
+
+// LowLatencyOptions returns options for real-time encoding where every Encode call outputs its frame:
+// zerolatency tuning with sliced threads and no sync lookahead, B-frames and rate control lookahead disabled.
+// Baseline profile is used for the widest decoder support, i.e. WebRTC. Set Bitrate and VBV fields for constrained links.
+func LowLatencyOptions(width, height, fps int) *Options {
+	return &Options{
+		Width:         width,
+		Height:        height,
+		FrameRate:     fps,
+		Preset:        "veryfast",
+		Tune:          "zerolatency",
+		Profile:       "baseline",
+		LogLevel:      LogError,
+		BFrames:       -1,
+		RCLookahead:   -1,
+		SlicedThreads: true,
+		KeyintMax:     2 * fps,
+	}
+}
+
+// GOPPlan represents the GOP structure x264 resolves from Options.
+type GOPPlan struct {
+	// Maximum IDR interval in frames, zero if unlimited. With IntraRefresh it is the refresh period.
+	KeyintMax int
+	// Minimum IDR interval in frames, closer scenecuts are coded as I frames.
+	KeyintMin int
+	// Scenecut threshold, zero if disabled.
+	SceneCut int
+	// Maximum number of consecutive B-frames.
+	BFrames int
+	// Whether B-frames are kept as references.
+	BFramePyramid bool
+	// Whether open GOPs are used.
+	OpenGOP bool
+	// Whether periodic intra refresh replaces IDR frames.
+	IntraRefresh bool
+	// Number of reference frames.
+	RefFrames int
+}
+
+// Plan returns the GOP structure the options would produce, without encoding.
+// The encoder is opened with the options to let x264 resolve automatic values, nothing is written and no stats file is used.
+// Callbacks and the AlphaWriter stream are not set up. It returns the error of invalid options.
+func (o *Options) Plan() (plan GOPPlan, err error) {
+	opts := *o
+	opts.Pass = 0
+	opts.DeferHeaders = true
+	opts.Logger = nil
+	opts.LogLevel = LogNone
+	opts.AlphaWriter = nil
+	opts.OnFrame, opts.OnKeyframe, opts.OnEncodeTime, opts.Telemetry = nil, nil, nil, nil
+
+	e, err := NewEncoder(ioutil.Discard, &opts)
+	if err != nil {
+		return
+	}
+	defer e.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(e.e, &param)
+
+	plan = GOPPlan{
+		KeyintMax:     int(param.IKeyintMax),
+		KeyintMin:     int(param.IKeyintMin),
+		SceneCut:      int(param.IScenecutThreshold),
+		BFrames:       int(param.IBframe),
+		BFramePyramid: param.IBframePyramid != x264c.BPyramidNone,
+		OpenGOP:       param.BOpenGop != 0,
+		IntraRefresh:  param.BIntraRefresh != 0,
+		RefFrames:     int(param.IFrameReference),
+	}
+
+	if plan.KeyintMax == x264c.KeyintMaxInfinite {
+		plan.KeyintMax = 0
+	}
+
+	return
+}
+
+// Validate checks options and returns an error naming the first invalid field.
+func (o *Options) Validate() error {
+	if o.Width <= 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid Width %d, must be positive", o.Width)
+	}
+
+	if o.Height <= 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid Height %d, must be positive", o.Height)
+	}
+
+	if err := o.checkCrop(); err != nil {
+		return err
+	}
+
+	if o.FrameRate <= 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid FrameRate %d, must be positive", o.FrameRate)
+	}
+
+	if err := CheckPreset(o.Preset, o.Tune); err != nil {
+		return err
+	}
+
+	if o.Profile != "" && !contains(profiles, o.Profile) {
+		return errorf(ErrInvalidPreset, "x264: invalid Profile %q", o.Profile)
+	}
+
+	if o.Level != "" {
+		l, ok := findLevel(o.Level)
+		if !ok {
+			return errorf(ErrInvalidOptions, "x264: invalid Level %q", o.Level)
+		}
+
+		err := o.checkLevel(l)
+		if err != nil {
+			return err
+		}
+
+		if o.Interlaced && (l.idc < 21 || l.idc > 41) {
+			return errorf(ErrInvalidOptions, "x264: invalid Level %q, interlaced coding requires level 2.1 to 4.1", o.Level)
+		}
+	}
+
+	if o.Interlaced && o.Profile == "baseline" {
+		return errorf(ErrInvalidOptions, "x264: invalid Profile %q, baseline profile does not support interlaced coding", o.Profile)
+	}
+
+	if mod := o.fieldHeightMod(); o.Interlaced && o.Height%mod != 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid Height %d, interlaced coding requires a multiple of %d", o.Height, mod)
+	}
+
+	if o.ColorSpace == ColorSpaceI400 && (o.Profile == "baseline" || o.Profile == "main") {
+		return errorf(ErrInvalidOptions, "x264: invalid Profile %q, 4:0:0 color space requires high profile", o.Profile)
+	}
+
+	if o.ColorSpace == ColorSpaceI422 && o.Profile != "" && o.Profile != "high422" && o.Profile != "high444" {
+		return errorf(ErrInvalidOptions, "x264: invalid Profile %q, 4:2:2 color space requires high422 or high444 profile", o.Profile)
+	}
+
+	if o.ColorSpace == ColorSpaceI444 && o.Profile != "" && o.Profile != "high444" {
+		return errorf(ErrInvalidOptions, "x264: invalid Profile %q, 4:4:4 color space requires high444 profile", o.Profile)
+	}
+
+	if o.Pass < 0 || o.Pass > 2 {
+		return errorf(ErrInvalidOptions, "x264: invalid Pass %d, must be 0, 1 or 2", o.Pass)
+	}
+
+	if o.Pass == 2 && o.RateControl != RateControlABR {
+		return errorf(ErrInvalidOptions, "x264: invalid Pass %d, second pass requires ABR rate control", o.Pass)
+	}
+
+	if o.KeyintMax < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid KeyintMax %d, must not be negative", o.KeyintMax)
+	}
+
+	if o.KeyintMin < 0 || (o.KeyintMax > 0 && o.KeyintMin > o.KeyintMax) {
+		return errorf(ErrInvalidOptions, "x264: invalid KeyintMin %d, must not be negative or greater than KeyintMax", o.KeyintMin)
+	}
+
+	if o.Threads < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid Threads %d, must not be negative", o.Threads)
+	}
+
+	if o.Deterministic && o.Threads > 1 {
+		return errorf(ErrInvalidOptions, "x264: invalid Threads %d, Deterministic encodes on a single thread", o.Threads)
+	}
+
+	if o.TelemetryInterval < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid TelemetryInterval %d, must not be negative", o.TelemetryInterval)
+	}
+
+	if o.SliceMaxSize < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid SliceMaxSize %d, must not be negative", o.SliceMaxSize)
+	}
+
+	if rows := (o.Height + 15) / 16; o.Slices < 0 || o.Slices > rows {
+		return errorf(ErrInvalidOptions, "x264: invalid Slices %d, must be between 0 and %d macroblock rows", o.Slices, rows)
+	}
+
+	if o.BFrames > 16 {
+		return errorf(ErrInvalidOptions, "x264: invalid BFrames %d, must be at most 16", o.BFrames)
+	}
+
+	if o.BFrames > 0 && contains(o.tuneList(), "zerolatency") {
+		return errorf(ErrInvalidOptions, "x264: invalid BFrames %d, B-frames cannot be used with zerolatency tuning", o.BFrames)
+	}
+
+	if o.BFrameAdaptive < BFrameAdaptiveDefault || o.BFrameAdaptive > BFrameAdaptiveTrellis {
+		return errorf(ErrInvalidOptions, "x264: invalid BFrameAdaptive %d", o.BFrameAdaptive)
+	}
+
+	if o.CQMPreset < CQMDefault || o.CQMPreset > CQMJVT {
+		return errorf(ErrInvalidOptions, "x264: invalid CQMPreset %d", o.CQMPreset)
+	}
+
+	if (o.CQMPreset == CQMJVT || o.CQM != nil) && (o.Profile == "baseline" || o.Profile == "main") {
+		return errorf(ErrInvalidOptions, "x264: invalid Profile %q, quantization matrices require high profile", o.Profile)
+	}
+
+	if o.CQM != nil && !o.CQM.valid() {
+		return errorf(ErrInvalidOptions, "x264: invalid CQM, values must be between 1 and 255")
+	}
+
+	if o.AQMode < AQModeDefault || o.AQMode > AQModeAutoVarianceBiased {
+		return errorf(ErrInvalidOptions, "x264: invalid AQMode %d", o.AQMode)
+	}
+
+	if o.AQStrength < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid AQStrength %v, must not be negative", o.AQStrength)
+	}
+
+	if o.RefFrames < 0 || o.RefFrames > 16 {
+		return errorf(ErrInvalidOptions, "x264: invalid RefFrames %d, must be between 0 and 16", o.RefFrames)
+	}
+
+	if o.DPBSize < 0 || o.DPBSize > 16 {
+		return errorf(ErrInvalidOptions, "x264: invalid DPBSize %d, must be between 0 and 16", o.DPBSize)
+	}
+
+	if o.Entropy < EntropyDefault || o.Entropy > EntropyCAVLC {
+		return errorf(ErrInvalidOptions, "x264: invalid Entropy %d", o.Entropy)
+	}
+
+	if o.Entropy == EntropyCABAC && o.Profile == "baseline" {
+		return errorf(ErrInvalidOptions, "x264: invalid Entropy, baseline profile does not allow CABAC")
+	}
+
+	if o.PsyRD > 10 {
+		return errorf(ErrInvalidOptions, "x264: invalid PsyRD %v, must not be greater than 10", o.PsyRD)
+	}
+
+	if o.PsyTrellis > 10 {
+		return errorf(ErrInvalidOptions, "x264: invalid PsyTrellis %v, must not be greater than 10", o.PsyTrellis)
+	}
+
+	if o.DisablePsy && (o.PsyRD > 0 || o.PsyTrellis > 0) {
+		return errorf(ErrInvalidOptions, "x264: invalid DisablePsy, cannot be combined with PsyRD or PsyTrellis")
+	}
+
+	if o.DeblockAlpha < -6 || o.DeblockAlpha > 6 {
+		return errorf(ErrInvalidOptions, "x264: invalid DeblockAlpha %d, must be between -6 and 6", o.DeblockAlpha)
+	}
+
+	if o.DeblockBeta < -6 || o.DeblockBeta > 6 {
+		return errorf(ErrInvalidOptions, "x264: invalid DeblockBeta %d, must be between -6 and 6", o.DeblockBeta)
+	}
+
+	if o.RCLookahead > 250 {
+		return errorf(ErrInvalidOptions, "x264: invalid RCLookahead %d, must not be greater than 250", o.RCLookahead)
+	}
+
+	if o.ColorRange < ColorRangeDefault || o.ColorRange > ColorRangeFull {
+		return errorf(ErrInvalidOptions, "x264: invalid ColorRange %d", o.ColorRange)
+	}
+
+	if o.ColorPrimaries != "" && !contains(colorPrimaries, o.ColorPrimaries) {
+		return errorf(ErrInvalidOptions, "x264: invalid ColorPrimaries %q", o.ColorPrimaries)
+	}
+
+	if o.TransferCharacteristics != "" && !contains(transfers, o.TransferCharacteristics) {
+		return errorf(ErrInvalidOptions, "x264: invalid TransferCharacteristics %q", o.TransferCharacteristics)
+	}
+
+	if o.ColorMatrix != "" && !contains(colorMatrices, o.ColorMatrix) {
+		return errorf(ErrInvalidOptions, "x264: invalid ColorMatrix %q", o.ColorMatrix)
+	}
+
+	if o.QPI < 0 || o.QPI > 51 {
+		return errorf(ErrInvalidOptions, "x264: invalid QPI %d, must be between 0 and 51", o.QPI)
+	}
+
+	if o.QPB < 0 || o.QPB > 51 {
+		return errorf(ErrInvalidOptions, "x264: invalid QPB %d, must be between 0 and 51", o.QPB)
+	}
+
+	if o.Timebase < 0 {
+		return errorf(ErrInvalidOptions, "x264: invalid Timebase %d, must not be negative", o.Timebase)
+	}
+
+	if o.CFR && o.VFR {
+		return errorf(ErrInvalidOptions, "x264: invalid CFR, cannot be used with VFR")
+	}
+
+	switch o.BitDepth {
+	case 0, 8, 10:
+	default:
+		return errorf(ErrInvalidOptions, "x264: invalid BitDepth %d, must be 8 or 10", o.BitDepth)
+	}
+
+	depth := o.BitDepth
+	if depth == 0 {
+		depth = 8
+	}
+
+	if x264c.BitDepth != 0 && x264c.BitDepth != depth {
+		return errorf(ErrInvalidOptions, "x264: invalid BitDepth %d, linked x264 does not support it", depth)
+	}
+
+	return nil
+}
+
+// checkCrop checks the crop fit the frame and the chroma subsampling of the color space.
+func (o *Options) checkCrop() error {
+	modX, modY := 1, 1
+	switch o.ColorSpace {
+	case ColorSpaceI420, ColorSpaceNV12:
+		modX, modY = 2, 2
+	case ColorSpaceI422:
+		modX = 2
+	}
+
+	if o.Interlaced {
+		modY *= 2
+	}
+
+	for _, c := range []struct {
+		name string
+		v    int
+		mod  int
+	}{{"CropLeft", o.CropLeft, modX}, {"CropTop", o.CropTop, modY}, {"CropRight", o.CropRight, modX}, {"CropBottom", o.CropBottom, modY}} {
+		if c.v < 0 || c.v%c.mod != 0 {
+			return errorf(ErrInvalidOptions, "x264: invalid %s %d, must be a non-negative multiple of %d", c.name, c.v, c.mod)
+		}
+	}
+
+	if o.CropLeft+o.CropRight >= o.Width {
+		return errorf(ErrInvalidOptions, "x264: invalid CropRight %d, crop leaves no picture", o.CropRight)
+	}
+
+	if o.CropTop+o.CropBottom >= o.Height {
+		return errorf(ErrInvalidOptions, "x264: invalid CropBottom %d, crop leaves no picture", o.CropBottom)
+	}
+
+	return nil
+}
+
+// alphaOptions returns the options of the AlphaWriter stream encoder.
+func (o *Options) alphaOptions() *Options {
+	a := *o
+	a.AlphaWriter = nil
+	a.ColorSpace = ColorSpaceI400
+	a.Pass = 0
+	a.CFR = false
+	a.OnFrame, a.OnKeyframe, a.OnEncodeTime, a.Telemetry = nil, nil, nil, nil
+
+	if a.Profile == "baseline" || a.Profile == "main" {
+		a.Profile = "high"
+	}
+
+	return &a
+}
+
+// valid reports whether all matrix values are non-zero.
+func (m *QuantMatrices) valid() bool {
+	for _, list := range [][]uint8{m.Intra4x4Luma[:], m.Inter4x4Luma[:], m.Intra4x4Chroma[:], m.Inter4x4Chroma[:],
+		m.Intra8x8Luma[:], m.Inter8x8Luma[:], m.Intra8x8Chroma[:], m.Inter8x8Chroma[:]} {
+		for _, v := range list {
+			if v == 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// fieldHeightMod returns the multiple interlaced frame heights must have, both fields hold whole chroma rows.
+func (o *Options) fieldHeightMod() int {
+	if o.ColorSpace == ColorSpaceI420 || o.ColorSpace == ColorSpaceNV12 {
+		return 4
+	}
+
+	return 2
+}
+
+// tuneList returns tunings from Tune, x264 accepts several tunings separated by comma or plus sign, i.e. "film,fastdecode".
+func (o *Options) tuneList() []string {
+	return splitTune(o.Tune)
+}
+
+// splitTune splits tune into tunings separated by comma or plus sign.
+func splitTune(tune string) []string {
+	return strings.FieldsFunc(tune, func(r rune) bool { return r == ',' || r == '+' })
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// equalMaps reports whether a and b hold the same entries.
+func equalMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+
+	return true
+}
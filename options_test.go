@@ -0,0 +1,228 @@
+package x264
+
+import (
+	"errors"
+	"image"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	valid := Options{Width: 640, Height: 480, FrameRate: 25, Preset: "veryfast", Tune: "film,fastdecode", Profile: "high"}
+
+	err := valid.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field  string
+		modify func(o *Options)
+	}{
+		{"Width", func(o *Options) { o.Width = 0 }},
+		{"Height", func(o *Options) { o.Height = -1 }},
+		{"CropLeft", func(o *Options) { o.CropLeft = 3 }},
+		{"CropTop", func(o *Options) { o.CropTop = -2 }},
+		{"CropRight", func(o *Options) { o.CropLeft, o.CropRight = 320, 320 }},
+		{"CropBottom", func(o *Options) { o.CropBottom = 480 }},
+		{"FrameRate", func(o *Options) { o.FrameRate = 0 }},
+		{"Preset", func(o *Options) { o.Preset = "superslow" }},
+		{"Tune", func(o *Options) { o.Tune = "film,cartoon" }},
+		{"Profile", func(o *Options) { o.Profile = "extended" }},
+		{"Level", func(o *Options) { o.Level = "4.3" }},
+		{"Level", func(o *Options) { o.Level = "2.1" }},
+		{"Level", func(o *Options) { o.Level, o.FrameRate = "3.0", 60 }},
+		{"Level", func(o *Options) { o.Level, o.VBVMaxRate = "3.0", 20000 }},
+		{"Level", func(o *Options) { o.Level, o.RateControl, o.Bitrate = "3.0", RateControlABR, 20000 }},
+		{"Profile", func(o *Options) { o.ColorSpace, o.Profile = ColorSpaceI400, "main" }},
+		{"Profile", func(o *Options) { o.ColorSpace, o.Profile = ColorSpaceI422, "high10" }},
+		{"Profile", func(o *Options) { o.ColorSpace, o.Profile = ColorSpaceI444, "high422" }},
+		{"CropLeft", func(o *Options) { o.ColorSpace, o.Profile, o.CropLeft = ColorSpaceI422, "high422", 1 }},
+		{"KeyintMax", func(o *Options) { o.KeyintMax = -1 }},
+		{"KeyintMin", func(o *Options) { o.KeyintMin = -1 }},
+		{"KeyintMin", func(o *Options) { o.KeyintMax, o.KeyintMin = 10, 20 }},
+		{"Timebase", func(o *Options) { o.Timebase = -1 }},
+		{"Threads", func(o *Options) { o.Threads = -2 }},
+		{"Threads", func(o *Options) { o.Deterministic, o.Threads = true, 4 }},
+		{"QPI", func(o *Options) { o.QPI = 52 }},
+		{"QPB", func(o *Options) { o.QPB = -1 }},
+		{"BFrames", func(o *Options) { o.BFrames = 17 }},
+		{"BFrames", func(o *Options) { o.Tune, o.BFrames = "zerolatency", 2 }},
+		{"SliceMaxSize", func(o *Options) { o.SliceMaxSize = -1 }},
+		{"TelemetryInterval", func(o *Options) { o.TelemetryInterval = -1 }},
+		{"Profile", func(o *Options) { o.Interlaced, o.Profile = true, "baseline" }},
+		{"Level", func(o *Options) { o.Interlaced, o.Level = true, "5.1" }},
+		{"Height", func(o *Options) { o.Interlaced, o.Height = true, 482 }},
+		{"CropTop", func(o *Options) { o.Interlaced, o.CropTop = true, 2 }},
+		{"Slices", func(o *Options) { o.Slices = -1 }},
+		{"Slices", func(o *Options) { o.Slices = 1000 }},
+		{"BFrameAdaptive", func(o *Options) { o.BFrameAdaptive = 4 }},
+		{"RefFrames", func(o *Options) { o.RefFrames = 17 }},
+		{"DPBSize", func(o *Options) { o.DPBSize = 17 }},
+		{"Entropy", func(o *Options) { o.Entropy = 3 }},
+		{"Entropy", func(o *Options) { o.Entropy, o.Profile = EntropyCABAC, "baseline" }},
+		{"CQMPreset", func(o *Options) { o.CQMPreset = 3 }},
+		{"Profile", func(o *Options) { o.CQMPreset, o.Profile = CQMJVT, "main" }},
+		{"CQM", func(o *Options) { o.CQM = &QuantMatrices{} }},
+		{"AQMode", func(o *Options) { o.AQMode = 5 }},
+		{"CFR", func(o *Options) { o.CFR, o.VFR = true, true }},
+		{"AQStrength", func(o *Options) { o.AQStrength = -1 }},
+		{"PsyRD", func(o *Options) { o.PsyRD = 11 }},
+		{"PsyTrellis", func(o *Options) { o.PsyTrellis = 10.5 }},
+		{"DisablePsy", func(o *Options) { o.DisablePsy, o.PsyRD = true, 1 }},
+		{"DeblockAlpha", func(o *Options) { o.DeblockAlpha = -7 }},
+		{"DeblockBeta", func(o *Options) { o.DeblockBeta = 7 }},
+		{"RCLookahead", func(o *Options) { o.RCLookahead = 251 }},
+		{"Pass", func(o *Options) { o.Pass = 3 }},
+		{"Pass", func(o *Options) { o.Pass = 2 }},
+		{"ColorRange", func(o *Options) { o.ColorRange = 3 }},
+		{"ColorPrimaries", func(o *Options) { o.ColorPrimaries = "bt601" }},
+		{"TransferCharacteristics", func(o *Options) { o.TransferCharacteristics = "srgb" }},
+		{"ColorMatrix", func(o *Options) { o.ColorMatrix = "rgb" }},
+		{"BitDepth", func(o *Options) { o.BitDepth = 12 }},
+	}
+
+	for _, tt := range tests {
+		o := valid
+		tt.modify(&o)
+
+		err := o.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.field) {
+			t.Errorf("expected error naming %s, got %v", tt.field, err)
+		}
+	}
+
+	for _, cs := range []int32{ColorSpaceI420, ColorSpaceNV12, ColorSpaceI422, ColorSpaceI444} {
+		odd := valid
+		odd.Width, odd.Height = 641, 481
+		odd.ColorSpace = cs
+		odd.Profile = "high444"
+
+		err = odd.Validate()
+		if err != nil {
+			t.Errorf("odd dimensions should be valid for color space %d, got %v", cs, err)
+		}
+	}
+}
+
+func TestStreamingOptions(t *testing.T) {
+	opts := StreamingOptions(1280, 720, 30, 2500)
+
+	err := opts.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.VBVMaxRate != 2500 || opts.VBVBufferSize != 2500 || opts.KeyintMax != 60 {
+		t.Errorf("unexpected streaming options %+v", opts)
+	}
+}
+
+func TestLowLatencyOptions(t *testing.T) {
+	opts := LowLatencyOptions(320, 240, 30)
+
+	enc, err := NewEncoder(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	var param x264c.Param
+	x264c.EncoderParameters(enc.e, &param)
+
+	if param.IBframe != 0 || param.Rc.ILookahead != 0 || param.ISyncLookahead != 0 {
+		t.Errorf("unexpected parameters bframes=%d lookahead=%d sync=%d", param.IBframe, param.Rc.ILookahead, param.ISyncLookahead)
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, opts.Width, opts.Height))
+
+	for i := 0; i < 10; i++ {
+		err = enc.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if enc.DelayedFrames() != 0 || enc.LastFrameSize() == 0 {
+			t.Fatalf("frame %d: %d delayed frames, last frame %d bytes", i, enc.DelayedFrames(), enc.LastFrameSize())
+		}
+	}
+}
+
+func TestCheckPreset(t *testing.T) {
+	for _, p := range ValidPresets() {
+		if err := CheckPreset(p, "zerolatency+fastdecode"); err != nil {
+			t.Errorf("preset %s: %v", p, err)
+		}
+	}
+
+	if err := CheckPreset("", ""); err != nil {
+		t.Errorf("empty names: %v", err)
+	}
+
+	if err := CheckPreset("superslow", ""); err == nil || !strings.Contains(err.Error(), "Preset") {
+		t.Errorf("expected error naming Preset, got %v", err)
+	}
+
+	if err := CheckPreset("fast", "film,cartoon"); err == nil || !strings.Contains(err.Error(), "cartoon") {
+		t.Errorf("expected error naming the tune, got %v", err)
+	}
+
+	if ps := ValidProfiles(); len(ps) == 0 || !contains(ps, "high") {
+		t.Errorf("unexpected profiles %v", ps)
+	}
+
+	// the returned slices are copies
+	ValidTunes()[0] = "x"
+	if !contains(ValidTunes(), "film") {
+		t.Error("ValidTunes returned the package slice")
+	}
+}
+
+func TestOptionsPlan(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "medium",
+		Profile:   "high",
+		LogLevel:  LogError,
+	}
+
+	plan, err := opts.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.KeyintMax != 25 || plan.KeyintMin == 0 || plan.KeyintMin > 25 {
+		t.Errorf("unexpected keyint %d/%d", plan.KeyintMax, plan.KeyintMin)
+	}
+
+	// medium preset defaults
+	if plan.BFrames != 3 || !plan.BFramePyramid || plan.RefFrames != 3 || plan.SceneCut != 40 {
+		t.Errorf("unexpected preset values %+v", plan)
+	}
+
+	opts.Tune = "zerolatency"
+	opts.IntraRefresh = true
+	opts.KeyintMax = 50
+
+	// the alpha stream encoder is not opened
+	opts.AlphaWriter = ioutil.Discard
+
+	plan, err = opts.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.BFrames != 0 || plan.BFramePyramid || !plan.IntraRefresh || plan.KeyintMax != 50 {
+		t.Errorf("unexpected zerolatency values %+v", plan)
+	}
+
+	opts.Preset = "unknown"
+	if plan, err = opts.Plan(); !errors.Is(err, ErrInvalidPreset) || plan != (GOPPlan{}) {
+		t.Errorf("expected zero plan and invalid preset error, got %+v, %v", plan, err)
+	}
+}
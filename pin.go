@@ -0,0 +1,26 @@
+//go:build go1.21
+// +build go1.21
+
+package x264
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// pinner passes Go plane buffers to x264 for the duration of a cgo call.
+// Buffers are pinned, so x264 reads them in place.
+type pinner struct {
+	p runtime.Pinner
+}
+
+// ptr returns pointer to b usable by C code until release.
+func (p *pinner) ptr(b []byte) unsafe.Pointer {
+	p.p.Pin(&b[0])
+	return unsafe.Pointer(&b[0])
+}
+
+// release unpins all buffers.
+func (p *pinner) release() {
+	p.p.Unpin()
+}
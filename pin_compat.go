@@ -0,0 +1,32 @@
+//go:build !go1.21
+// +build !go1.21
+
+package x264
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import "unsafe"
+
+// pinner passes Go plane buffers to x264 for the duration of a cgo call.
+// Pinning is not available before Go 1.21, so buffers are copied to C memory.
+type pinner struct {
+	ptrs []unsafe.Pointer
+}
+
+// ptr returns pointer to a copy of b usable by C code until release.
+func (p *pinner) ptr(b []byte) unsafe.Pointer {
+	c := C.CBytes(b)
+	p.ptrs = append(p.ptrs, c)
+	return c
+}
+
+// release frees all copies.
+func (p *pinner) release() {
+	for _, c := range p.ptrs {
+		C.free(c)
+	}
+	p.ptrs = nil
+}
@@ -0,0 +1,114 @@
+package x264
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Pool is a fixed set of encoders with identical options, it bounds the number of concurrent streams.
+// Pool methods are safe for concurrent use, an Encoder is not and must be used by one goroutine at a time.
+type Pool struct {
+	opts Options
+	free chan *Encoder
+
+	mu sync.Mutex
+	// options each encoder was opened with, Reconfig and ChangeResolution replace them
+	opened map[*Encoder]*Options
+}
+
+// NewPool returns new pool of size encoders opened with opts.
+func NewPool(opts *Options, size int) (p *Pool, err error) {
+	if size < 1 {
+		err = errorf(ErrInvalidOptions, "x264: invalid pool size %d", size)
+		return
+	}
+
+	p = &Pool{opts: *opts, free: make(chan *Encoder, size), opened: make(map[*Encoder]*Options, size)}
+
+	for i := 0; i < size; i++ {
+		var e *Encoder
+		e, err = p.newEncoder()
+		if err != nil {
+			p.Close()
+			p = nil
+			return
+		}
+
+		p.free <- e
+	}
+
+	return
+}
+
+// newEncoder opens a new encoder with the pool options.
+func (p *Pool) newEncoder() (e *Encoder, err error) {
+	e, err = NewEncoder(ioutil.Discard, &p.opts)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.opened[e] = e.opts
+	p.mu.Unlock()
+
+	return
+}
+
+// Get waits for a free encoder and resets it to start a new stream written to w.
+func (p *Pool) Get(w io.Writer) (e *Encoder, err error) {
+	e = <-p.free
+
+	err = e.Reset(w)
+	if err != nil {
+		p.Put(e)
+		e = nil
+	}
+
+	return
+}
+
+// Put returns encoder e to the pool, frames still delayed in e are discarded on the next Get.
+// Flush e first to write them. A closed encoder, or one changed with Reconfig or ChangeResolution, is replaced with a new one.
+func (p *Pool) Put(e *Encoder) {
+	e.w = ioutil.Discard
+	e.writers = nil
+
+	p.mu.Lock()
+	changed := e.opts != p.opened[e]
+	p.mu.Unlock()
+
+	if e.e == nil || changed {
+		e.Close()
+
+		// on failure the closed encoder is kept, Get then returns its error
+		if n, err := p.newEncoder(); err == nil {
+			p.mu.Lock()
+			delete(p.opened, e)
+			p.mu.Unlock()
+
+			e = n
+		}
+	}
+
+	p.free <- e
+}
+
+// Close closes the free encoders in the pool, encoders that are in use must be closed by their users.
+// Get must not be called afterwards.
+func (p *Pool) Close() (err error) {
+	for {
+		select {
+		case e := <-p.free:
+			if er := e.Close(); er != nil && err == nil {
+				err = er
+			}
+
+			p.mu.Lock()
+			delete(p.opened, e)
+			p.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package x264
+
+import "image"
+
+// resize scales src to w x h with bilinear filtering and converts it to YCbCr with convert, writing into p.
+// Samples of *image.YCbCr and *image.Gray sources are scaled as they are, like unscaled images are copied.
+func (p *YCbCr) resize(src image.Image, w, h int, convert func(r, g, b uint8) (uint8, uint8, uint8)) {
+	b := src.Bounds()
+
+	var at func(x, y int) (int32, int32, int32)
+	switch s := src.(type) {
+	case *image.YCbCr:
+		at = func(x, y int) (int32, int32, int32) {
+			c := s.COffset(x, y)
+			return int32(s.Y[s.YOffset(x, y)]), int32(s.Cb[c]), int32(s.Cr[c])
+		}
+
+		convert = nil
+	case *image.Gray:
+		at = func(x, y int) (int32, int32, int32) {
+			return int32(s.Pix[s.PixOffset(x, y)]), 128, 128
+		}
+
+		convert = nil
+	case *image.RGBA:
+		at = func(x, y int) (int32, int32, int32) {
+			i := s.PixOffset(x, y)
+			return int32(s.Pix[i]), int32(s.Pix[i+1]), int32(s.Pix[i+2])
+		}
+	default:
+		at = func(x, y int) (int32, int32, int32) {
+			r, g, bl, _ := src.At(x, y).RGBA()
+			return int32(r >> 8), int32(g >> 8), int32(bl >> 8)
+		}
+	}
+
+	xs0, xs1, xw := resizeTaps(b.Min.X, b.Dx(), w)
+	ys0, ys1, yw := resizeTaps(b.Min.Y, b.Dy(), h)
+
+	for row := 0; row < h; row++ {
+		wy := yw[row]
+
+		for col := 0; col < w; col++ {
+			wx := xw[col]
+
+			r00, g00, b00 := at(xs0[col], ys0[row])
+			r01, g01, b01 := at(xs1[col], ys0[row])
+			r10, g10, b10 := at(xs0[col], ys1[row])
+			r11, g11, b11 := at(xs1[col], ys1[row])
+
+			r := lerp(lerp(r00, r01, wx), lerp(r10, r11, wx), wy)
+			g := lerp(lerp(g00, g01, wx), lerp(g10, g11, wx), wy)
+			bl := lerp(lerp(b00, b01, wx), lerp(b10, b11, wx), wy)
+
+			y, cb, cr := uint8(r), uint8(g), uint8(bl)
+			if convert != nil {
+				y, cb, cr = convert(y, cb, cr)
+			}
+
+			p.Y[p.YOffset(col, row)] = y
+			p.Cb[p.COffset(col, row)] = cb
+			p.Cr[p.COffset(col, row)] = cr
+		}
+	}
+}
+
+// resizeTaps returns source sample positions and 8-bit weights of the second sample for scaling n samples at min to m.
+func resizeTaps(min, n, m int) (s0, s1 []int, w []int32) {
+	s0 = make([]int, m)
+	s1 = make([]int, m)
+	w = make([]int32, m)
+
+	for i := 0; i < m; i++ {
+		// sample centers, in 1/256 units
+		pos := ((2*i+1)*n*256/m - 256) / 2
+		if pos < 0 {
+			pos = 0
+		}
+
+		j := pos >> 8
+		if j >= n-1 {
+			j, pos = n-1, (n-1)<<8
+		}
+
+		s0[i] = min + j
+		s1[i] = min + j
+		if j < n-1 {
+			s1[i]++
+		}
+
+		w[i] = int32(pos - j<<8)
+	}
+
+	return
+}
+
+// lerp interpolates between a and b with 8-bit weight w of b.
+func lerp(a, b, w int32) int32 {
+	return (a*(256-w) + b*w + 128) >> 8
+}
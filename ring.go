@@ -0,0 +1,125 @@
+package x264
+
+import (
+	"io"
+	"sync"
+)
+
+// readerBufferSize is the capacity of the stream buffer of NewReaderEncoder.
+const readerBufferSize = 1 << 20
+
+// ringBuffer is a fixed size pipe, writes block while it is full and reads block while it is empty.
+type ringBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	buf []byte
+	r   int
+	n   int
+
+	// writes have ended, with werr or io.EOF
+	wclosed bool
+	werr    error
+	// reader has gone away
+	rclosed bool
+}
+
+// newRingBuffer returns new ring buffer of the given size.
+func newRingBuffer(size int) *ringBuffer {
+	b := &ringBuffer{buf: make([]byte, size)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write writes all of p, waiting for the reader to make room.
+func (b *ringBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(p) > 0 {
+		for b.n == len(b.buf) && !b.rclosed && !b.wclosed {
+			b.cond.Wait()
+		}
+
+		if b.rclosed || b.wclosed {
+			err = io.ErrClosedPipe
+			return
+		}
+
+		w := (b.r + b.n) % len(b.buf)
+		end := len(b.buf)
+		if w < b.r {
+			end = b.r
+		}
+
+		c := copy(b.buf[w:end], p)
+		b.n += c
+		n += c
+		p = p[c:]
+
+		b.cond.Broadcast()
+	}
+
+	return
+}
+
+// Read reads buffered stream, waiting for data until the writer is closed.
+func (b *ringBuffer) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.n == 0 && !b.wclosed && !b.rclosed {
+		b.cond.Wait()
+	}
+
+	if b.rclosed {
+		err = io.ErrClosedPipe
+		return
+	}
+
+	if b.n == 0 {
+		err = b.werr
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+
+	for n < len(p) && b.n > 0 {
+		end := b.r + b.n
+		if end > len(b.buf) {
+			end = len(b.buf)
+		}
+
+		c := copy(p[n:], b.buf[b.r:end])
+		b.r = (b.r + c) % len(b.buf)
+		b.n -= c
+		n += c
+	}
+
+	b.cond.Broadcast()
+	return
+}
+
+// Close closes the reading side, pending and later writes fail with io.ErrClosedPipe.
+func (b *ringBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rclosed = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// closeWrite ends the stream, reads return err, or io.EOF if nil, once the buffer is drained.
+func (b *ringBuffer) closeWrite(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.wclosed {
+		b.wclosed = true
+		b.werr = err
+	}
+
+	b.cond.Broadcast()
+}
@@ -0,0 +1,464 @@
+package x264
+
+import (
+	"encoding/binary"
+	"image"
+	"time"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+// Segment represents a completed fragmented MP4 media segment.
+type Segment struct {
+	// Sequence number, starting at 1.
+	Sequence uint32
+	// Decode time of the first frame and segment duration, in Timescale units.
+	DecodeTime int64
+	Duration   int64
+	// Number of frames, the first one is a keyframe.
+	Frames int
+	// The moof and mdat boxes.
+	Data []byte
+}
+
+// Segmenter encodes frames to fragmented MP4 for CMAF, DASH and LL-HLS packagers: an init segment with the SPS and PPS,
+// followed by media segments that each start with a keyframe. A keyframe is forced on the first frame at or after every
+// segment duration, so segments are cut on a regular grid, scenecut keyframes in between do not start a new segment.
+// Sample times are in Timescale units, decode times start at zero and composition offsets are signed.
+type Segmenter struct {
+	e *Encoder
+
+	onSegment func(seg Segment)
+	onFrame   func(info FrameInfo, b []byte)
+
+	init []byte
+
+	timescale int64
+	// segment duration and default frame duration in timescale units
+	target int64
+	frame  int64
+
+	// PTS from which the next input frame is forced to a keyframe
+	nextCut   int64
+	cutPlaced bool
+	// PTS of the frames forced to keyframes that start a segment once output
+	cuts map[int64]bool
+
+	started  bool
+	firstPTS int64
+	firstDTS int64
+
+	seq     uint32
+	segPTS  int64
+	samples []segmentSample
+}
+
+// segmentSample represents an encoded frame of the current segment.
+type segmentSample struct {
+	data     []byte
+	pts, dts int64
+	keyframe bool
+}
+
+// NewSegmenter returns new Segmenter cutting about duration long segments, onSegment is called with every completed
+// segment. The encoder is opened with AVCC NAL format and headers only in the init segment, OnFrame is still called.
+// It cannot be used with CFR conversion.
+func NewSegmenter(opts *Options, duration time.Duration, onSegment func(seg Segment)) (s *Segmenter, err error) {
+	if duration <= 0 {
+		err = errorf(ErrInvalidOptions, "x264: invalid segment duration %v", duration)
+		return
+	}
+
+	if opts.CFR {
+		err = errorf(ErrInvalidOptions, "x264: Segmenter cannot be used with CFR, pass timestamps with VFR")
+		return
+	}
+
+	s = &Segmenter{cuts: make(map[int64]bool)}
+	s.onSegment = onSegment
+	s.onFrame = opts.OnFrame
+
+	s.timescale = int64(opts.FrameRate)
+	if opts.VFR && opts.Timebase > 0 {
+		s.timescale = int64(opts.Timebase)
+	}
+
+	if opts.FrameRate > 0 {
+		s.frame = s.timescale / int64(opts.FrameRate)
+	}
+	if s.frame < 1 {
+		s.frame = 1
+	}
+
+	s.target = int64(duration) * s.timescale / int64(time.Second)
+	if s.target < 1 {
+		s.target = 1
+	}
+
+	o := *opts
+	o.NALFormat = NALFormatAVCC
+	o.DeferHeaders = true
+	o.NoRepeatHeaders = true
+	o.OnFrame = s.addFrame
+
+	s.e, err = NewEncoder(nil, &o)
+	if err != nil {
+		s = nil
+		return
+	}
+
+	sps, pps, err := s.e.Headers()
+	if err != nil {
+		s.e.Close()
+		s = nil
+		return
+	}
+
+	s.init = s.initSegment(sps, pps)
+
+	return
+}
+
+// Init returns the init segment, the ftyp and moov boxes.
+func (s *Segmenter) Init() []byte {
+	return s.init
+}
+
+// Timescale returns the number of time units per second of segment and sample times.
+func (s *Segmenter) Timescale() int {
+	return int(s.timescale)
+}
+
+// Encoder returns the underlying encoder, i.e. for Stats. Frames encoded with it directly are segmented as well.
+func (s *Segmenter) Encoder() *Encoder {
+	return s.e
+}
+
+// Encode encodes image, see Encoder.Encode.
+func (s *Segmenter) Encode(im image.Image) error {
+	s.placeCut(s.e.pts)
+
+	return s.e.Encode(im)
+}
+
+// EncodeWithPTS encodes image with the presentation timestamp in Timescale units, see Encoder.EncodeWithPTS.
+func (s *Segmenter) EncodeWithPTS(im image.Image, pts int64) error {
+	s.placeCut(pts)
+
+	return s.e.EncodeWithPTS(im, pts)
+}
+
+// Close flushes delayed frames, emits the last segment and closes the encoder.
+func (s *Segmenter) Close() (err error) {
+	if s.e.e != nil {
+		err = s.e.Flush()
+	}
+
+	if len(s.samples) > 0 {
+		s.emit(s.samples[len(s.samples)-1].dts + s.lastDuration())
+	}
+
+	if er := s.e.Close(); err == nil {
+		err = er
+	}
+
+	return
+}
+
+// placeCut forces a keyframe if the frame with pts reaches the next segment boundary and records it as a cut.
+func (s *Segmenter) placeCut(pts int64) {
+	if !s.cutPlaced {
+		s.cutPlaced = true
+		s.nextCut = pts + s.target
+		return
+	}
+
+	if pts < s.nextCut {
+		return
+	}
+
+	for s.nextCut <= pts {
+		s.nextCut += s.target
+	}
+
+	s.cuts[pts] = true
+	s.e.ForceKeyframe()
+}
+
+// addFrame is the OnFrame callback of the encoder, it starts a new segment at the keyframes forced by placeCut,
+// and for frames encoded directly with the encoder at keyframes past the segment duration.
+func (s *Segmenter) addFrame(info FrameInfo, b []byte) {
+	if s.onFrame != nil {
+		s.onFrame(info, b)
+	}
+
+	if !s.started {
+		s.started = true
+		s.firstPTS = info.PTS
+		s.firstDTS = info.DTS
+	}
+
+	cut := s.cuts[info.PTS]
+	delete(s.cuts, info.PTS)
+
+	if info.Keyframe && len(s.samples) > 0 && (cut || info.PTS-s.segPTS >= s.target) {
+		s.emit(info.DTS - s.firstDTS)
+	}
+
+	if len(s.samples) == 0 {
+		s.segPTS = info.PTS
+	}
+
+	s.samples = append(s.samples, segmentSample{
+		data:     b,
+		pts:      info.PTS - s.firstPTS,
+		dts:      info.DTS - s.firstDTS,
+		keyframe: info.Keyframe,
+	})
+}
+
+// lastDuration returns the duration of the last sample when no frame follows it.
+func (s *Segmenter) lastDuration() int64 {
+	if n := len(s.samples); n > 1 {
+		return s.samples[n-1].dts - s.samples[n-2].dts
+	}
+
+	return s.frame
+}
+
+// emit writes the current samples as a segment ending at decode time end and passes it to onSegment.
+func (s *Segmenter) emit(end int64) {
+	s.seq++
+
+	moof := s.moof(0, end)
+	moof = s.moof(len(moof)+8, end)
+
+	size := len(moof) + 8
+	for _, smp := range s.samples {
+		size += len(smp.data)
+	}
+
+	data := make([]byte, 0, size)
+	data = append(data, moof...)
+	data = append(data, u32(uint32(size-len(moof)))...)
+	data = append(data, "mdat"...)
+	for _, smp := range s.samples {
+		data = append(data, smp.data...)
+	}
+
+	seg := Segment{
+		Sequence:   s.seq,
+		DecodeTime: s.samples[0].dts,
+		Duration:   end - s.samples[0].dts,
+		Frames:     len(s.samples),
+		Data:       data,
+	}
+
+	for i := range s.samples {
+		s.samples[i] = segmentSample{}
+	}
+	s.samples = s.samples[:0]
+
+	if s.onSegment != nil {
+		s.onSegment(seg)
+	}
+}
+
+// moof returns the moof box of the current samples, dataOffset is the offset of the first sample from the moof start.
+func (s *Segmenter) moof(dataOffset int, end int64) []byte {
+	const (
+		trunDataOffset        = 0x000001
+		trunDuration          = 0x000100
+		trunSize              = 0x000200
+		trunFlags             = 0x000400
+		trunCompositionOffset = 0x000800
+
+		flagsSync    = 0x02000000
+		flagsNonSync = 0x01010000
+	)
+
+	trun := make([]byte, 0, 8+16*len(s.samples))
+	trun = append(trun, u32(uint32(len(s.samples)))...)
+	trun = append(trun, u32(uint32(dataOffset))...)
+
+	for i, smp := range s.samples {
+		next := end
+		if i+1 < len(s.samples) {
+			next = s.samples[i+1].dts
+		}
+
+		flags := uint32(flagsNonSync)
+		if smp.keyframe {
+			flags = flagsSync
+		}
+
+		trun = append(trun, u32(uint32(next-smp.dts))...)
+		trun = append(trun, u32(uint32(len(smp.data)))...)
+		trun = append(trun, u32(flags)...)
+		trun = append(trun, u32(uint32(int32(smp.pts-smp.dts)))...)
+	}
+
+	return box("moof",
+		fullBox("mfhd", 0, 0, u32(s.seq)),
+		box("traf",
+			// default-base-is-moof
+			fullBox("tfhd", 0, 0x020000, u32(1)),
+			fullBox("tfdt", 1, 0, u64(uint64(s.samples[0].dts))),
+			fullBox("trun", 1, trunDataOffset|trunDuration|trunSize|trunFlags|trunCompositionOffset, trun),
+		),
+	)
+}
+
+// initSegment returns the ftyp and moov boxes of a single H.264 track.
+func (s *Segmenter) initSegment(sps, pps []byte) []byte {
+	width, height := uint32(s.e.opts.Width), uint32(s.e.opts.Height)
+	timescale := u32(uint32(s.timescale))
+
+	matrix := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = append(matrix, u32(v)...)
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		// creation and modification time
+		u32(0), u32(0),
+		timescale,
+		// duration
+		u32(0),
+		// rate, volume and reserved
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		matrix,
+		// pre_defined
+		make([]byte, 24),
+		// next_track_ID
+		u32(2),
+	)
+
+	tkhd := fullBox("tkhd", 0, 0x000003,
+		u32(0), u32(0),
+		// track_ID, reserved and duration
+		u32(1), u32(0), u32(0),
+		// reserved, layer, alternate_group, volume and reserved
+		make([]byte, 16),
+		matrix,
+		u32(width<<16), u32(height<<16),
+	)
+
+	mdhd := fullBox("mdhd", 0, 0,
+		u32(0), u32(0),
+		timescale,
+		u32(0),
+		// language und
+		u16(0x55c4), u16(0),
+	)
+
+	hdlr := fullBox("hdlr", 0, 0,
+		u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"),
+	)
+
+	avc1 := box("avc1",
+		// reserved and data_reference_index
+		make([]byte, 6), u16(1),
+		// pre_defined and reserved
+		make([]byte, 16),
+		u16(uint16(width)), u16(uint16(height)),
+		// 72 dpi resolution and reserved
+		u32(0x00480000), u32(0x00480000), u32(0),
+		// frame_count, compressorname, depth and pre_defined
+		u16(1), make([]byte, 32), u16(0x0018), u16(0xffff),
+		box("avcC", s.avcConfig(sps, pps)),
+	)
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), avc1),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+
+	minf := box("minf",
+		fullBox("vmhd", 0, 0x000001, make([]byte, 8)),
+		box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 0x000001))),
+		stbl,
+	)
+
+	mvex := box("mvex",
+		// track_ID, default sample description index, duration, size and flags
+		fullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)),
+	)
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0), []byte("iso6"), []byte("avc1"))
+	moov := box("moov", mvhd, box("trak", tkhd, box("mdia", mdhd, hdlr, minf)), mvex)
+
+	return append(ftyp, moov...)
+}
+
+// avcConfig returns the AVCDecoderConfigurationRecord with 4 byte NAL lengths.
+func (s *Segmenter) avcConfig(sps, pps []byte) []byte {
+	b := []byte{1, sps[1], sps[2], sps[3], 0xfc | 3, 0xe0 | 1}
+	b = append(b, u16(uint16(len(sps)))...)
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = append(b, u16(uint16(len(pps)))...)
+	b = append(b, pps...)
+
+	// high profiles carry chroma format and bit depth
+	switch sps[1] {
+	case 100, 110, 122, 144, 244:
+		var chroma byte
+		switch s.e.csp {
+		case x264c.CspI420, x264c.CspNv12:
+			chroma = 1
+		case x264c.CspI422:
+			chroma = 2
+		case x264c.CspI444:
+			chroma = 3
+		}
+
+		depth := byte(s.e.depth - 8)
+		b = append(b, 0xfc|chroma, 0xf8|depth, 0xf8|depth, 0)
+	}
+
+	return b
+}
+
+// box returns an MP4 box of type typ with the concatenated payload.
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	b := make([]byte, 0, size)
+	b = append(b, u32(uint32(size))...)
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+// fullBox returns an MP4 full box with version and flags.
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	return box(typ, append([][]byte{u32(uint32(version)<<24 | flags)}, payload...)...)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
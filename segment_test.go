@@ -0,0 +1,245 @@
+package x264
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mp4Boxes returns the boxes in b by type, payloads exclude the box header.
+func mp4Boxes(t *testing.T, b []byte) (types []string, boxes map[string][]byte) {
+	t.Helper()
+
+	boxes = make(map[string][]byte)
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header %x", b)
+		}
+
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("invalid box size %d of %d bytes", size, len(b))
+		}
+
+		typ := string(b[4:8])
+		types = append(types, typ)
+		boxes[typ] = b[8:size]
+		b = b[size:]
+	}
+
+	return
+}
+
+// mp4Path returns the payload of the box at path, full box headers are not skipped.
+func mp4Path(t *testing.T, b []byte, path ...string) []byte {
+	t.Helper()
+
+	for _, typ := range path {
+		_, boxes := mp4Boxes(t, b)
+
+		var ok bool
+		b, ok = boxes[typ]
+		if !ok {
+			t.Fatalf("missing %s box in %v", typ, path)
+		}
+	}
+
+	return b
+}
+
+func TestSegmenter(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Preset:    "veryfast",
+		Profile:   "high",
+		KeyintMax: 250,
+		SceneCut:  -1,
+		LogLevel:  LogError,
+	}
+
+	var segs []Segment
+	s, err := NewSegmenter(opts, time.Second, func(seg Segment) {
+		segs = append(segs, seg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sps, pps, err := s.Encoder().Headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types, _ := mp4Boxes(t, s.Init())
+	if len(types) != 2 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("init segment boxes %v", types)
+	}
+
+	// stsd full box header and entry count, avc1 sample entry fields
+	stsd := mp4Path(t, s.Init(), "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	avc1 := mp4Path(t, stsd[8:], "avc1")
+	avcC := mp4Path(t, avc1[78:], "avcC")
+
+	want := append([]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+	want = append(append(want, 1, 0, byte(len(pps))), pps...)
+	if !bytes.HasPrefix(avcC, want) {
+		t.Errorf("avcC %x, want prefix %x", avcC, want)
+	}
+
+	if s.Timescale() != 25 {
+		t.Errorf("timescale %d, want 25", s.Timescale())
+	}
+
+	for i := 0; i < 110; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+		for j := range img.Pix {
+			img.Pix[j] = uint8(j/4%320 + 2*i)
+		}
+
+		err = s.Encode(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segs) != 5 {
+		t.Fatalf("got %d segments, want 5", len(segs))
+	}
+
+	var decodeTime int64
+	var pts []int64
+
+	for i, seg := range segs {
+		wantFrames := 25
+		if i == len(segs)-1 {
+			wantFrames = 10
+		}
+
+		if seg.Sequence != uint32(i+1) || seg.DecodeTime != decodeTime || seg.Frames != wantFrames || seg.Duration != int64(wantFrames) {
+			t.Errorf("segment %d: sequence %d, decode time %d, %d frames, duration %d", i, seg.Sequence, seg.DecodeTime, seg.Frames, seg.Duration)
+		}
+		decodeTime += seg.Duration
+
+		types, boxes := mp4Boxes(t, seg.Data)
+		if len(types) != 2 || types[0] != "moof" || types[1] != "mdat" {
+			t.Fatalf("segment %d boxes %v", i, types)
+		}
+
+		tfdt := mp4Path(t, boxes["moof"], "traf", "tfdt")
+		if d := int64(binary.BigEndian.Uint64(tfdt[4:])); d != seg.DecodeTime {
+			t.Errorf("segment %d: tfdt %d, want %d", i, d, seg.DecodeTime)
+		}
+
+		trun := mp4Path(t, boxes["moof"], "traf", "trun")
+		n := int(binary.BigEndian.Uint32(trun[4:]))
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		if n != seg.Frames {
+			t.Fatalf("segment %d: trun has %d samples, want %d", i, n, seg.Frames)
+		}
+
+		if offset != len(seg.Data)-len(boxes["mdat"]) {
+			t.Errorf("segment %d: data offset %d does not point to mdat payload", i, offset)
+		}
+
+		dts := seg.DecodeTime
+		data := seg.Data[offset:]
+
+		for j := 0; j < n; j++ {
+			entry := trun[12+16*j:]
+			duration := int64(binary.BigEndian.Uint32(entry))
+			size := int(binary.BigEndian.Uint32(entry[4:]))
+			flags := binary.BigEndian.Uint32(entry[8:])
+			cts := int64(int32(binary.BigEndian.Uint32(entry[12:])))
+
+			if sync := flags&0x00010000 == 0; sync != (j == 0) {
+				t.Errorf("segment %d sample %d: flags %08x", i, j, flags)
+			}
+
+			// samples hold whole length prefixed NAL units
+			sample := data[:size]
+			for len(sample) > 0 {
+				l := int(binary.BigEndian.Uint32(sample)) + 4
+				if l > len(sample) {
+					t.Fatalf("segment %d sample %d: NAL unit of %d bytes overruns the sample", i, j, l)
+				}
+				sample = sample[l:]
+			}
+			data = data[size:]
+
+			pts = append(pts, dts+cts)
+			dts += duration
+		}
+
+		if len(data) != 0 {
+			t.Errorf("segment %d: %d bytes of mdat not covered by samples", i, len(data))
+		}
+	}
+
+	sort.Slice(pts, func(i, j int) bool { return pts[i] < pts[j] })
+	for i := range pts {
+		if pts[i] != int64(i) {
+			t.Fatalf("presentation times %v, want 0 to %d", pts, len(pts)-1)
+		}
+	}
+}
+
+func TestSegmenterJitter(t *testing.T) {
+	opts := &Options{
+		Width:     320,
+		Height:    240,
+		FrameRate: 25,
+		Timebase:  1000,
+		VFR:       true,
+		Preset:    "veryfast",
+		Profile:   "high",
+		KeyintMax: 250,
+		SceneCut:  -1,
+		LogLevel:  LogError,
+	}
+
+	var segs []Segment
+	s, err := NewSegmenter(opts, time.Second, func(seg Segment) {
+		segs = append(segs, seg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 40 ms frames with +-5 ms jitter, so frames land just before and after the 1 s cut grid
+	for i := 0; i < 150; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+		for j := range img.Pix {
+			img.Pix[j] = uint8(j/4%320 + 2*i)
+		}
+
+		err = s.EncodeWithPTS(img, int64(i)*40+int64(i%3-1)*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segs) != 6 {
+		t.Fatalf("got %d segments, want 6", len(segs))
+	}
+
+	for i, seg := range segs[:len(segs)-1] {
+		if seg.Duration < 950 || seg.Duration > 1050 {
+			t.Errorf("segment %d: duration %d ms, want about 1000", i, seg.Duration)
+		}
+	}
+}
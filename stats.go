@@ -0,0 +1,249 @@
+package x264
+
+import (
+	"math"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+// Stats represents encoding statistics.
+type Stats struct {
+	// Number of encoded frames.
+	Frames int
+	// Number of IDR frames.
+	FramesIDR int
+	// Number of I frames, including IDR frames.
+	FramesI int
+	// Number of P frames.
+	FramesP int
+	// Number of B frames, including reference B frames.
+	FramesB int
+	// Number of input frames dropped and of repeated frames inserted by CFR conversion.
+	FramesDropped  int
+	FramesRepeated int
+	// Total size of encoded frames in bytes, stream headers written by NewEncoder are not included.
+	Bytes int64
+	// Average bitrate in kbps, computed from Bytes and FrameRate, with VFR from the PTS span of the frames in Timebase units.
+	Bitrate float64
+	// Average quantizer.
+	AvgQP float64
+	// Average PSNR in dB, populated only with psnr tuning and LogLevel LogInfo or higher.
+	PSNR float64
+	// Average SSIM, populated only with ssim tuning and LogLevel LogInfo or higher.
+	SSIM float64
+}
+
+// TelemetrySnapshot represents encoder health passed to the Telemetry callback.
+type TelemetrySnapshot struct {
+	// Number of encoded frames.
+	Frames int
+	// Total size of encoded frames in bytes.
+	Bytes int64
+	// PTS of the last encoded frame.
+	PTS int64
+	// Average bitrate in kbps over the frames since the previous snapshot, computed from FrameRate,
+	// with VFR from the PTS span of the frames in Timebase units.
+	Bitrate float64
+	// Estimated VBV buffer fullness from 0 to 1, modeled as VBVBufferSize filled by the frames and drained at VBVMaxRate.
+	// Values near 1 mean rate control has to lower quality to respect VBV. Zero if VBV is not enabled.
+	VBVFullness float64
+}
+
+// ResourceStats represents the known memory allocations and threads of an encoder.
+// Memory allocated by x264 itself, i.e. lookahead and reference frames, is not included.
+type ResourceStats struct {
+	// Size of the Go YCbCr image buffer in bytes, including the interleaved chroma buffer for NV12.
+	ImageBytes int
+	// Size of the C plane buffers for image input in bytes, zero after Close.
+	PlaneBytes int
+	// Size of the NewReaderEncoder stream buffer in bytes, zero for other encoders.
+	ReaderBytes int
+	// Number of frame threads and lookahead threads x264 uses, resolved from auto settings. Zero after Close.
+	Threads          int
+	LookaheadThreads int
+}
+
+// stats accumulates per frame statistics.
+type stats struct {
+	Stats
+
+	qp   float64
+	psnr float64
+	ssim float64
+
+	// PTS range of all encoded frames
+	minPTS int64
+	maxPTS int64
+
+	// size and keyframe flag of the frame output by the last encode call
+	last         int
+	lastKeyframe bool
+
+	// frames, bytes and PTS range since the last telemetry snapshot, and modeled VBV buffer level in bits
+	windowFrames int
+	windowBytes  int64
+	windowMinPTS int64
+	windowMaxPTS int64
+	vbv          float64
+}
+
+// add accumulates statistics of encoded frame.
+func (s *stats) add(info FrameInfo, size int32, picOut *x264c.Picture) {
+	if s.Frames == 0 || info.PTS < s.minPTS {
+		s.minPTS = info.PTS
+	}
+	if s.Frames == 0 || info.PTS > s.maxPTS {
+		s.maxPTS = info.PTS
+	}
+
+	s.Frames++
+	s.Bytes += int64(size)
+	s.qp += float64(info.QP)
+	s.psnr += picOut.Prop.FPsnrAvg
+	s.ssim += picOut.Prop.FSsim
+
+	switch info.Type {
+	case FrameIDR:
+		s.FramesIDR++
+		s.FramesI++
+	case FrameI:
+		s.FramesI++
+	case FrameP:
+		s.FramesP++
+	case FrameB, FrameBref:
+		s.FramesB++
+	}
+}
+
+// telemetry updates the telemetry counters with encoded frame and calls Telemetry every TelemetryInterval frames.
+func (e *Encoder) telemetry(info FrameInfo, size int32) {
+	s, o := &e.stats, e.opts
+
+	vbv := o.VBVMaxRate > 0 && o.VBVBufferSize > 0
+	if vbv {
+		s.vbv += float64(size)*8 - float64(o.VBVMaxRate)*1000/float64(o.FrameRate)
+		if s.vbv < 0 {
+			s.vbv = 0
+		}
+	}
+
+	if s.windowFrames == 0 || info.PTS < s.windowMinPTS {
+		s.windowMinPTS = info.PTS
+	}
+	if s.windowFrames == 0 || info.PTS > s.windowMaxPTS {
+		s.windowMaxPTS = info.PTS
+	}
+
+	s.windowFrames++
+	s.windowBytes += int64(size)
+
+	interval := o.TelemetryInterval
+	if interval == 0 {
+		interval = o.FrameRate
+	}
+
+	if o.Telemetry == nil || s.windowFrames < interval {
+		return
+	}
+
+	duration := o.duration(s.windowFrames, s.windowMinPTS, s.windowMaxPTS)
+
+	snap := TelemetrySnapshot{
+		Frames:  s.Frames,
+		Bytes:   s.Bytes,
+		PTS:     info.PTS,
+		Bitrate: float64(s.windowBytes) * 8 / duration / 1000,
+	}
+
+	if vbv {
+		snap.VBVFullness = math.Min(s.vbv/float64(o.VBVBufferSize*1000), 1)
+	}
+
+	s.windowFrames, s.windowBytes = 0, 0
+
+	o.Telemetry(snap)
+}
+
+// duration returns the duration in seconds of frames with PTS from minPTS to maxPTS, each frame lasts until the next one.
+// It is computed from FrameRate, with VFR from the PTS span.
+func (o *Options) duration(frames int, minPTS, maxPTS int64) float64 {
+	if !o.VFR || frames < 2 || maxPTS <= minPTS {
+		return float64(frames) / float64(o.FrameRate)
+	}
+
+	tb := o.Timebase
+	if tb == 0 {
+		tb = o.FrameRate
+	}
+
+	span := float64(maxPTS-minPTS) / float64(tb)
+	return span * float64(frames) / float64(frames-1)
+}
+
+// BytesWritten returns the number of stream bytes written by Encode and Flush, stream headers included.
+// Payloads returned by EncodeFrame are not counted. A nil writer is counted as written.
+func (e *Encoder) BytesWritten() int64 {
+	return e.written
+}
+
+// FramesEncoded returns the number of frames written by Encode and Flush, the frames BytesWritten counts.
+// Frames returned by EncodeFrame are counted in Stats.Frames only.
+func (e *Encoder) FramesEncoded() int64 {
+	return e.writtenFrames
+}
+
+// LastFrameSize returns the size in bytes of the frame output by the last Encode or Flush step,
+// zero if x264 delayed it.
+func (e *Encoder) LastFrameSize() int {
+	return e.stats.last
+}
+
+// LastFrameKeyframe reports whether the frame output by the last Encode or Flush step is a keyframe,
+// false if x264 delayed it.
+func (e *Encoder) LastFrameKeyframe() bool {
+	return e.stats.lastKeyframe
+}
+
+// Stats returns encoding statistics, it can be called after Close.
+func (e *Encoder) Stats() Stats {
+	st := e.stats.Stats
+	if st.Frames == 0 {
+		return st
+	}
+
+	n := float64(st.Frames)
+
+	st.Bitrate = float64(st.Bytes) * 8 / e.opts.duration(st.Frames, e.stats.minPTS, e.stats.maxPTS) / 1000
+	st.AvgQP = e.stats.qp / n
+	st.PSNR = e.stats.psnr / n
+	st.SSIM = e.stats.ssim / n
+
+	return st
+}
+
+// ResourceStats returns the known memory allocations and thread counts of the encoder.
+func (e *Encoder) ResourceStats() (rs ResourceStats) {
+	if e.img != nil {
+		rs.ImageBytes = len(e.img.Y) + len(e.img.Cb) + len(e.img.Cr) + len(e.cbcr)
+	}
+
+	for i := range e.cplanes {
+		if e.cplanes[i] != nil {
+			rs.PlaneBytes += e.cplanesLen[i]
+		}
+	}
+
+	if e.ring != nil {
+		rs.ReaderBytes = len(e.ring.buf)
+	}
+
+	if e.e != nil {
+		var param x264c.Param
+		x264c.EncoderParameters(e.e, &param)
+
+		rs.Threads = int(param.IThreads)
+		rs.LookaheadThreads = int(param.ILookaheadThreads)
+	}
+
+	return
+}
@@ -0,0 +1,52 @@
+package x264
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samespace/x264-go/x264c"
+)
+
+// Version returns the version of the linked x264 library, i.e. "0.163.3060 5db6aa6".
+// The bundled sources do not record the revision, only "0.163" is returned for them.
+func Version() string {
+	if v := x264c.PointVersion(); v != "" {
+		return v
+	}
+
+	return fmt.Sprintf("0.%d", x264c.Build)
+}
+
+// BuildInfo returns a description of the linked x264 library, i.e.
+// "x264 0.163 build 163, 8-bit, all chroma formats, gpl, interlaced".
+func BuildInfo() string {
+	depth := "8-bit and 10-bit"
+	if x264c.BitDepth != 0 {
+		depth = fmt.Sprintf("%d-bit", x264c.BitDepth)
+	}
+
+	chroma := "all chroma formats"
+	switch x264c.ChromaFormat() {
+	case 0:
+	case x264c.CspI400:
+		chroma = "4:0:0 only"
+	case x264c.CspI420:
+		chroma = "4:2:0 only"
+	case x264c.CspI422:
+		chroma = "4:2:2 only"
+	case x264c.CspI444:
+		chroma = "4:4:4 only"
+	default:
+		chroma = fmt.Sprintf("chroma format %#x only", x264c.ChromaFormat())
+	}
+
+	info := []string{fmt.Sprintf("x264 %s build %d", Version(), x264c.Build), depth, chroma}
+	if x264c.Gpl != 0 {
+		info = append(info, "gpl")
+	}
+	if x264c.Interlaced != 0 {
+		info = append(info, "interlaced")
+	}
+
+	return strings.Join(info, ", ")
+}
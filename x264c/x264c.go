@@ -5,6 +5,13 @@ package x264c
 #include "stdint.h"
 #include "x264.h"
 #include <stdlib.h>
+
+// X264_POINTVER is defined by x264_config.h of an installed library only.
+#ifndef X264_POINTVER
+#define X264_POINTVER ""
+#endif
+
+static const char *x264c_pointver(void) { return X264_POINTVER; }
 */
 import "C"
 
@@ -13,6 +20,11 @@ import "unsafe"
 // Constants.
 const (
 	Build = C.X264_BUILD
+	// Supported bit depth of the linked library, 0 if both 8 and 10 bits are supported.
+	BitDepth = C.X264_BIT_DEPTH
+	// Whether the linked library is built with GPL-only features and with interlaced encoding support.
+	Gpl        = C.X264_GPL
+	Interlaced = C.X264_INTERLACED
 
 	// CPU flags.
 	CpuMmx = (1 << 0)
@@ -426,6 +438,30 @@ type CropRect struct {
 	Bottom uint32
 }
 
+// MasteringDisplay (mastering display SEI parameters) type.
+type MasteringDisplay struct {
+	// Enable writing this SEI.
+	BMasteringDisplay int32
+	IGreenX           int32
+	IGreenY           int32
+	IBlueX            int32
+	IBlueY            int32
+	IRedX             int32
+	IRedY             int32
+	IWhiteX           int32
+	IWhiteY           int32
+	IDisplayMax       int64
+	IDisplayMin       int64
+}
+
+// ContentLightLevel (content light level SEI parameters) type.
+type ContentLightLevel struct {
+	// Enable writing this SEI.
+	BCll     int32
+	IMaxCll  int32
+	IMaxFall int32
+}
+
 // Zone type.
 // Zones: override ratecontrol or other options for specific sections of the video.
 // See EncoderReconfig() for which options can be changed.
@@ -630,6 +666,11 @@ func ParamDefaultPreset(param *Param, preset string, tune string) int32 {
 	return v
 }
 
+// ParamCleanup - frees the strings ParamParse allocated in param.
+func ParamCleanup(param *Param) {
+	C.x264_param_cleanup(param.cptr())
+}
+
 // ParamApplyFastfirstpass - if first-pass mode is set (rc.b_stat_read == 0, rc.b_stat_write == 1),
 // modify the encoder settings to disable options generally not useful on the first pass.
 func ParamApplyFastfirstpass(param *Param) {
@@ -786,3 +827,14 @@ func EncoderInvalidateReference(enc *T, pts int) int32 {
 	v := (int32)(ret)
 	return v
 }
+
+// PointVersion - version of the linked library with revision, i.e. "0.163.3060 5db6aa6".
+// Empty for the bundled sources.
+func PointVersion() string {
+	return C.GoString(C.x264c_pointver())
+}
+
+// ChromaFormat - the only Csp the linked library supports encoding, 0 if there are no restrictions.
+func ChromaFormat() int32 {
+	return int32(C.x264_chroma_format)
+}
@@ -65,10 +65,11 @@ type Param struct {
 	IBframeAdaptive int32
 	IBframeBias     int32
 	// Keep some B-frames as references: 0=off, 1=strict hierarchical, 2=normal.
-	IBframePyramid int32
-	BOpenGop       int32
-	BBlurayCompat  int32
-	IAvcintraClass int32
+	IBframePyramid  int32
+	BOpenGop        int32
+	BBlurayCompat   int32
+	IAvcintraClass  int32
+	IAvcintraFlavor int32
 
 	BDeblockingFilter int32
 	// [-6, 6] -6 light filter, 6 strong.
@@ -83,7 +84,6 @@ type Param struct {
 	BConstrainedIntra int32
 
 	ICqmPreset int32
-	_          [4]byte
 	// Filename (in UTF-8) of CQM file, JM format.
 	PszCqmFile *int8
 
@@ -120,6 +120,16 @@ type Param struct {
 	// Frame packing arrangement flag.
 	IFramePacking int32
 
+	// Mastering display SEI: primary and white point chromaticity coordinates in 0.00002 increments.
+	// Brightness units are 0.0001 cd/m^2.
+	MasteringDisplay MasteringDisplay
+
+	// Content light level SEI.
+	ContentLightLevel ContentLightLevel
+
+	// Alternative transfer SEI.
+	IAlternativeTransfer int32
+
 	// Muxing parameters.
 	// Generate access unit delimiters.
 	BAud int32
@@ -164,7 +174,6 @@ type Param struct {
 	BOpencl int32
 	// Specify count of GPU devices to skip, for CLI users.
 	IOpenclDevice int32
-	_             [4]byte
 	// Pass explicit cl_device_id as void*, for API users.
 	OpenclDeviceId unsafe.Pointer
 	// Filename (in UTF-8) of the compiled OpenCL kernel cache file.
@@ -182,9 +191,11 @@ type Param struct {
 	// Absolute cap on slices per frame; stops applying slice-max-size and slice-max-mbs if this is reached.
 	ISliceCountMax int32
 
-	_           [4]byte
 	ParamFree   *[0]byte
 	NaluProcess *[0]byte
+
+	// For internal use only.
+	Opaque unsafe.Pointer
 }
 
 // cptr return C pointer.
@@ -38,17 +38,16 @@ func (p *YCbCr) setYCbCr(x, y int, c color.YCbCr) {
 
 // ToYCbCrDraw converts image.Image to YCbCr.
 func (p *YCbCr) ToYCbCrDraw(src image.Image) {
-	bounds := src.Bounds()
-	draw.Draw(p, bounds, src, bounds.Min, draw.Src)
+	draw.Draw(p, p.Rect, src, src.Bounds().Min, draw.Src)
 }
 
 // ToYCbCrColor converts image.Image to YCbCr.
 func (p *YCbCr) ToYCbCrColor(src image.Image) {
 	bounds := src.Bounds()
 
-	for row := 0; row < bounds.Max.Y; row++ {
-		for col := 0; col < bounds.Max.X; col++ {
-			r, g, b, _ := src.At(col, row).RGBA()
+	for row := 0; row < bounds.Dy(); row++ {
+		for col := 0; col < bounds.Dx(); col++ {
+			r, g, b, _ := src.At(bounds.Min.X+col, bounds.Min.Y+row).RGBA()
 			y, cb, cr := color.RGBToYCbCr(uint8(r), uint8(g), uint8(b))
 
 			p.Y[p.YOffset(col, row)] = y
@@ -58,19 +57,253 @@ func (p *YCbCr) ToYCbCrColor(src image.Image) {
 	}
 }
 
-// ToYCbCr converts image.Image to YCbCr.
+// ToYCbCr converts image.RGBA or image.NRGBA to YCbCr using BT.601 coefficients with studio color range.
+// Alpha of image.NRGBA is ignored.
 func (p *YCbCr) ToYCbCr(src image.Image) {
+	if nrgba, ok := src.(*image.NRGBA); ok {
+		p.fromNRGBA(nrgba, RGBToYCbCrBT601)
+		return
+	}
+
 	bounds := src.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 
+	rgba := src.(*image.RGBA)
+	if rgba.Stride != 4*width {
+		// sub-images keep the stride of the parent image
+		p.fromRGB(rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y):], rgba.Stride, 4, width, height, RGBToYCbCrBT601)
+		return
+	}
+
 	lumaSize := int32(width * height)
 	chromaSize := int32(width*height) / 4
 
 	yuvProc := yuv.NewYuvImgProcessor(width, height)
-	yCbCr := yuvProc.Process(src.(*image.RGBA)).Get()
+	yCbCr := yuvProc.Process(rgba).Get()
 
 	p.Y = yCbCr[:lumaSize]
 	p.Cb = yCbCr[lumaSize : lumaSize+chromaSize]
 	p.Cr = yCbCr[lumaSize+chromaSize:]
 }
+
+// ToYCbCrBT709 converts image.Image to YCbCr using BT.709 coefficients with studio color range.
+// Alpha of image.NRGBA is ignored.
+func (p *YCbCr) ToYCbCrBT709(src image.Image) {
+	if nrgba, ok := src.(*image.NRGBA); ok {
+		p.fromNRGBA(nrgba, RGBToYCbCrBT709)
+		return
+	}
+
+	bounds := src.Bounds()
+	rgba, _ := src.(*image.RGBA)
+
+	for row := 0; row < bounds.Dy(); row++ {
+		for col := 0; col < bounds.Dx(); col++ {
+			var r, g, b uint8
+			if rgba != nil {
+				i := rgba.PixOffset(bounds.Min.X+col, bounds.Min.Y+row)
+				r, g, b = rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2]
+			} else {
+				r32, g32, b32, _ := src.At(bounds.Min.X+col, bounds.Min.Y+row).RGBA()
+				r, g, b = uint8(r32>>8), uint8(g32>>8), uint8(b32>>8)
+			}
+
+			y, cb, cr := RGBToYCbCrBT709(r, g, b)
+
+			p.Y[p.YOffset(col, row)] = y
+			p.Cb[p.COffset(col, row)] = cb
+			p.Cr[p.COffset(col, row)] = cr
+		}
+	}
+}
+
+// RGBToYCbCrBT709 converts an RGB triple to a BT.709 Y'CbCr triple with studio color range.
+func RGBToYCbCrBT709(r, g, b uint8) (uint8, uint8, uint8) {
+	r1, g1, b1 := int32(r), int32(g), int32(b)
+
+	y := (11966*r1+40254*g1+4064*b1+1<<15)>>16 + 16
+	cb := (-6596*r1-22188*g1+28784*b1+1<<15)>>16 + 128
+	cr := (28784*r1-26145*g1-2639*b1+1<<15)>>16 + 128
+
+	return uint8(y), uint8(cb), uint8(cr)
+}
+
+// RGBToYCbCrBT601 converts an RGB triple to a BT.601 Y'CbCr triple with studio color range.
+func RGBToYCbCrBT601(r, g, b uint8) (uint8, uint8, uint8) {
+	r1, g1, b1 := int32(r), int32(g), int32(b)
+
+	y := (16829*r1+33039*g1+6416*b1+1<<15)>>16 + 16
+	cb := (-9714*r1-19070*g1+28784*b1+1<<15)>>16 + 128
+	cr := (28784*r1-24103*g1-4681*b1+1<<15)>>16 + 128
+
+	return uint8(y), uint8(cb), uint8(cr)
+}
+
+// FromNV21 fills the image from NV21 planes, a full Y plane followed by an interleaved CrCb plane, with the given strides.
+// The image must be 4:2:0.
+func (p *YCbCr) FromNV21(y, vu []byte, strideY, strideVU int) {
+	p.fromNV21(y, vu, strideY, strideVU, p.Rect.Dx(), p.Rect.Dy())
+}
+
+// fromNV21 is like FromNV21 for the w x h top left area.
+func (p *YCbCr) fromNV21(y, vu []byte, strideY, strideVU, w, h int) {
+	for row := 0; row < h; row++ {
+		copy(p.Y[row*p.YStride:row*p.YStride+w], y[row*strideY:row*strideY+w])
+	}
+
+	cw, ch := (w+1)/2, (h+1)/2
+
+	for row := 0; row < ch; row++ {
+		src := vu[row*strideVU : row*strideVU+2*cw]
+		cb := p.Cb[row*p.CStride : row*p.CStride+cw]
+		cr := p.Cr[row*p.CStride : row*p.CStride+cw]
+
+		for i := range cb {
+			cr[i] = src[2*i]
+			cb[i] = src[2*i+1]
+		}
+	}
+}
+
+// FromRGB24 fills the image from packed 8-bit RGB pixels with the given stride, using BT.601 studio range coefficients.
+// Chroma of 4:2:0 and 4:2:2 images is converted from the average color of each 2x2 or 2x1 block.
+func (p *YCbCr) FromRGB24(pix []byte, stride int) {
+	p.fromRGB(pix, stride, 3, p.Rect.Dx(), p.Rect.Dy(), RGBToYCbCrBT601)
+}
+
+// fromNRGBA converts src with conversion function convert. Alpha is ignored, colors are converted as stored
+// instead of premultiplied as draw does.
+func (p *YCbCr) fromNRGBA(src *image.NRGBA, convert func(r, g, b uint8) (uint8, uint8, uint8)) {
+	b := src.Rect
+	p.fromRGB(src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, 4, b.Dx(), b.Dy(), convert)
+}
+
+// fromRGB is like FromRGB24 for the w x h top left area, with bpp bytes per pixel starting with R, G and B,
+// and conversion function convert.
+func (p *YCbCr) fromRGB(pix []byte, stride, bpp, w, h int, convert func(r, g, b uint8) (uint8, uint8, uint8)) {
+	sx, sy := p.subsampling()
+	sub := sx > 1 || sy > 1
+
+	for row := 0; row < h; row++ {
+		src := pix[row*stride : row*stride+bpp*w]
+		dst := p.Y[row*p.YStride : row*p.YStride+w]
+
+		for col := range dst {
+			y, cb, cr := convert(src[bpp*col], src[bpp*col+1], src[bpp*col+2])
+			dst[col] = y
+
+			if !sub {
+				p.Cb[row*p.CStride+col] = cb
+				p.Cr[row*p.CStride+col] = cr
+			}
+		}
+	}
+
+	if !sub {
+		return
+	}
+
+	for row := 0; row < (h+sy-1)/sy; row++ {
+		for col := 0; col < (w+sx-1)/sx; col++ {
+			var r, g, b, n int
+
+			for y := sy * row; y < sy*row+sy && y < h; y++ {
+				for x := sx * col; x < sx*col+sx && x < w; x++ {
+					i := y*stride + bpp*x
+					r, g, b, n = r+int(pix[i]), g+int(pix[i+1]), b+int(pix[i+2]), n+1
+				}
+			}
+
+			_, cb, cr := convert(uint8((r+n/2)/n), uint8((g+n/2)/n), uint8((b+n/2)/n))
+			p.Cb[row*p.CStride+col] = cb
+			p.Cr[row*p.CStride+col] = cr
+		}
+	}
+}
+
+// subsampling returns the horizontal and vertical chroma subsampling factors of the 4:2:0, 4:2:2 or 4:4:4 image.
+func (p *YCbCr) subsampling() (sx, sy int) {
+	switch p.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	}
+
+	return 1, 1
+}
+
+// interleaveCbCr writes Cb and Cr planes into dst as one interleaved plane.
+func (p *YCbCr) interleaveCbCr(dst []byte) {
+	for i := range p.Cb {
+		dst[2*i] = p.Cb[i]
+		dst[2*i+1] = p.Cr[i]
+	}
+}
+
+// padEdges repeats the last luma column and row of the w x h area over the rest of the image.
+func (p *YCbCr) padEdges(w, h int) {
+	dx, dy := p.Rect.Dx(), p.Rect.Dy()
+
+	for y := 0; y < h; y++ {
+		row := p.Y[y*p.YStride : y*p.YStride+dx]
+		for x := w; x < dx; x++ {
+			row[x] = row[w-1]
+		}
+	}
+
+	last := p.Y[(h-1)*p.YStride : (h-1)*p.YStride+dx]
+	for y := h; y < dy; y++ {
+		copy(p.Y[y*p.YStride:y*p.YStride+dx], last)
+	}
+}
+
+// fromGray copies luma from src, chroma planes are left unchanged.
+func (p *YCbCr) fromGray(src *image.Gray) {
+	b := src.Bounds()
+
+	for y := 0; y < b.Dy(); y++ {
+		i := src.PixOffset(b.Min.X, b.Min.Y+y)
+		copy(p.Y[y*p.YStride:y*p.YStride+b.Dx()], src.Pix[i:i+b.Dx()])
+	}
+}
+
+// fillChroma sets all chroma samples to v.
+func (p *YCbCr) fillChroma(v byte) {
+	for i := range p.Cb {
+		p.Cb[i] = v
+		p.Cr[i] = v
+	}
+}
+
+// canCopy reports whether planes of w x h image src can be copied directly with fromYCbCr.
+func (p *YCbCr) canCopy(src *image.YCbCr, w, h int) bool {
+	if src == p.YCbCr || src.SubsampleRatio != p.SubsampleRatio || src.Rect.Size() != image.Pt(w, h) {
+		return false
+	}
+
+	// chroma rows and columns are aligned with luma only at offsets that are multiples of the subsampling
+	sx, sy := p.subsampling()
+	return src.Rect.Min.X%sx == 0 && src.Rect.Min.Y%sy == 0
+}
+
+// fromYCbCr copies planes of src with the same subsample ratio, respecting its strides.
+func (p *YCbCr) fromYCbCr(src *image.YCbCr) {
+	b := src.Rect
+	w, h := b.Dx(), b.Dy()
+
+	for y := 0; y < h; y++ {
+		i := src.YOffset(b.Min.X, b.Min.Y+y)
+		copy(p.Y[y*p.YStride:y*p.YStride+w], src.Y[i:i+w])
+	}
+
+	sx, sy := p.subsampling()
+	cw, ch := (w+sx-1)/sx, (h+sy-1)/sy
+
+	for y := 0; y < ch; y++ {
+		i := src.COffset(b.Min.X, b.Min.Y+sy*y)
+		copy(p.Cb[y*p.CStride:y*p.CStride+cw], src.Cb[i:i+cw])
+		copy(p.Cr[y*p.CStride:y*p.CStride+cw], src.Cr[i:i+cw])
+	}
+}
@@ -2,6 +2,8 @@ package x264
 
 import (
 	"image"
+	"image/color"
+	"image/draw"
 	"testing"
 )
 
@@ -20,3 +22,224 @@ func TestYCbCr(t *testing.T) {
 		t.Error("ToYCbCr failed")
 	}
 }
+
+func TestRGBToYCbCrBT709(t *testing.T) {
+	tests := []struct {
+		r, g, b    uint8
+		y, cb, cr  uint8
+		y601, c601 uint8
+	}{
+		{255, 255, 255, 235, 128, 128, 255, 128},
+		{0, 0, 0, 16, 128, 128, 0, 128},
+		{255, 0, 0, 63, 102, 240, 76, 85},
+		{0, 255, 0, 173, 42, 26, 150, 44},
+		{0, 0, 255, 32, 240, 118, 29, 255},
+	}
+
+	for _, tt := range tests {
+		y, cb, cr := RGBToYCbCrBT709(tt.r, tt.g, tt.b)
+		if y != tt.y || cb != tt.cb || cr != tt.cr {
+			t.Errorf("BT.709 %d,%d,%d = %d,%d,%d, want %d,%d,%d", tt.r, tt.g, tt.b, y, cb, cr, tt.y, tt.cb, tt.cr)
+		}
+
+		// Go's conversion is BT.601 full range
+		y, cb, _ = color.RGBToYCbCr(tt.r, tt.g, tt.b)
+		if y != tt.y601 || cb != tt.c601 {
+			t.Errorf("BT.601 %d,%d,%d = %d,%d, want %d,%d", tt.r, tt.g, tt.b, y, cb, tt.y601, tt.c601)
+		}
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		copy(rgba.Pix[i:], []byte{255, 0, 0, 255})
+	}
+
+	img := NewYCbCr(rgba.Bounds())
+	img.ToYCbCrBT709(rgba)
+
+	if img.Y[0] != 63 || img.Cb[0] != 102 || img.Cr[0] != 240 {
+		t.Errorf("unexpected converted red %d,%d,%d", img.Y[0], img.Cb[0], img.Cr[0])
+	}
+}
+
+func TestYCbCrFromYCbCr(t *testing.T) {
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio444} {
+		big := image.NewYCbCr(image.Rect(0, 0, 100, 80), ratio)
+		for i := range big.Y {
+			big.Y[i] = uint8(i)
+		}
+		for i := range big.Cb {
+			big.Cb[i] = uint8(i * 3)
+			big.Cr[i] = uint8(i * 7)
+		}
+
+		src := big.SubImage(image.Rect(10, 20, 73, 67)).(*image.YCbCr)
+
+		dst := &YCbCr{image.NewYCbCr(image.Rect(0, 0, 63, 47), ratio)}
+		if !dst.canCopy(src, 63, 47) {
+			t.Fatalf("ratio %v: expected direct copy", ratio)
+		}
+
+		dst.fromYCbCr(src)
+
+		for y := 0; y < 47; y++ {
+			for x := 0; x < 63; x++ {
+				if got, want := dst.YCbCrAt(x, y), src.YCbCrAt(x+10, y+20); got != want {
+					t.Fatalf("ratio %v: pixel %d,%d = %v, want %v", ratio, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	odd := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420).SubImage(image.Rect(1, 0, 33, 16)).(*image.YCbCr)
+	if NewYCbCr(image.Rect(0, 0, 32, 16)).canCopy(odd, 32, 16) {
+		t.Error("expected no direct copy for odd chroma offset")
+	}
+}
+
+func TestRGBToYCbCrBT601(t *testing.T) {
+	tests := []struct {
+		r, g, b   uint8
+		y, cb, cr uint8
+	}{
+		{255, 255, 255, 235, 128, 128},
+		{0, 0, 0, 16, 128, 128},
+		{255, 0, 0, 81, 90, 240},
+		{0, 255, 0, 145, 54, 34},
+		{0, 0, 255, 41, 240, 110},
+	}
+
+	for _, tt := range tests {
+		y, cb, cr := RGBToYCbCrBT601(tt.r, tt.g, tt.b)
+		if y != tt.y || cb != tt.cb || cr != tt.cr {
+			t.Errorf("BT.601 %d,%d,%d = %d,%d,%d, want %d,%d,%d", tt.r, tt.g, tt.b, y, cb, cr, tt.y, tt.cb, tt.cr)
+		}
+	}
+}
+
+func TestYCbCrFromNV21(t *testing.T) {
+	img := NewYCbCr(image.Rect(0, 0, 5, 3))
+
+	y := make([]byte, 6*3)
+	for i := range y {
+		y[i] = byte(i)
+	}
+
+	// 3x2 chroma samples, stride 8
+	vu := []byte{
+		1, 2, 3, 4, 5, 6, 0, 0,
+		7, 8, 9, 10, 11, 12, 0, 0,
+	}
+
+	img.FromNV21(y, vu, 6, 8)
+
+	if img.Y[img.YOffset(4, 2)] != 16 {
+		t.Errorf("unexpected luma %d", img.Y[img.YOffset(4, 2)])
+	}
+
+	if c := img.COffset(4, 2); img.Cr[c] != 11 || img.Cb[c] != 12 {
+		t.Errorf("unexpected chroma cb=%d cr=%d, want 12 and 11", img.Cb[c], img.Cr[c])
+	}
+}
+
+func TestYCbCrFromRGB24(t *testing.T) {
+	img := NewYCbCr(image.Rect(0, 0, 3, 2))
+
+	// red, red, blue on both rows, stride 10
+	row := []byte{255, 0, 0, 255, 0, 0, 0, 0, 255, 0}
+	pix := append(append([]byte{}, row...), row...)
+
+	img.FromRGB24(pix, len(row))
+
+	if img.Y[0] != 81 || img.Y[2] != 41 {
+		t.Errorf("unexpected luma %v", img.Y)
+	}
+
+	if img.Cb[0] != 90 || img.Cr[0] != 240 {
+		t.Errorf("unexpected red chroma cb=%d cr=%d", img.Cb[0], img.Cr[0])
+	}
+
+	if img.Cb[1] != 240 || img.Cr[1] != 110 {
+		t.Errorf("unexpected blue chroma cb=%d cr=%d", img.Cb[1], img.Cr[1])
+	}
+
+	img444 := &YCbCr{image.NewYCbCr(image.Rect(0, 0, 3, 2), image.YCbCrSubsampleRatio444)}
+	img444.FromRGB24(pix, len(row))
+
+	if img444.Cb[2] != 240 || img444.Cr[0] != 240 {
+		t.Errorf("unexpected 4:4:4 chroma %v %v", img444.Cb, img444.Cr)
+	}
+
+	img422 := &YCbCr{image.NewYCbCr(image.Rect(0, 0, 3, 2), image.YCbCrSubsampleRatio422)}
+	img422.FromRGB24(pix, len(row))
+
+	if img422.Cb[0] != 90 || img422.Cb[1] != 240 || img422.Cb[img422.CStride+1] != 240 {
+		t.Errorf("unexpected 4:2:2 chroma %v %v", img422.Cb, img422.Cr)
+	}
+}
+
+func TestYCbCrFromNRGBA(t *testing.T) {
+	// semi-transparent gray gradient, with an offset origin
+	src := image.NewNRGBA(image.Rect(2, 1, 6, 3))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			v := uint8(85 * x)
+			src.SetNRGBA(2+x, 1+y, color.NRGBA{v, v, v, uint8(64 * (x + 1))})
+		}
+	}
+
+	img := NewYCbCr(image.Rect(0, 0, 4, 2))
+	img.ToYCbCr(src)
+
+	for x := 0; x < 4; x++ {
+		want, _, _ := RGBToYCbCrBT601(uint8(85*x), uint8(85*x), uint8(85*x))
+		if img.Y[x] != want || img.Y[img.YStride+x] != want {
+			t.Errorf("column %d: unexpected luma %d, want %d", x, img.Y[x], want)
+		}
+	}
+
+	if img.Y[3] != 235 {
+		t.Errorf("expected white luma 235, got %d", img.Y[3])
+	}
+
+	if img.Cb[0] != 128 || img.Cr[1] != 128 {
+		t.Errorf("unexpected gray chroma %v %v", img.Cb, img.Cr)
+	}
+
+	img.ToYCbCrBT709(src)
+	if want, _, _ := RGBToYCbCrBT709(170, 170, 170); img.Y[2] != want {
+		t.Errorf("unexpected BT.709 luma %d, want %d", img.Y[2], want)
+	}
+}
+
+func TestYCbCrSubImage(t *testing.T) {
+	parent := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range parent.Pix {
+		parent.Pix[i] = uint8(i * 7 % 251)
+	}
+
+	r := image.Rect(10, 6, 42, 30)
+	sub := parent.SubImage(r).(*image.RGBA)
+
+	// standalone copy of the region with a packed stride
+	flat := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(flat, flat.Rect, parent, r.Min, draw.Src)
+
+	for _, convert := range []func(p *YCbCr, src image.Image){(*YCbCr).ToYCbCr, (*YCbCr).ToYCbCrBT709, (*YCbCr).ToYCbCrColor} {
+		a, b := NewYCbCr(flat.Rect), NewYCbCr(flat.Rect)
+		convert(a, flat)
+		convert(b, sub)
+
+		for i := range a.Y {
+			if d := int(a.Y[i]) - int(b.Y[i]); d < -1 || d > 1 {
+				t.Fatalf("luma %d differs, %d and %d", i, a.Y[i], b.Y[i])
+			}
+		}
+
+		for i := range a.Cb {
+			if d := int(a.Cb[i]) - int(b.Cb[i]); d < -2 || d > 2 {
+				t.Fatalf("chroma %d differs, %d and %d", i, a.Cb[i], b.Cb[i])
+			}
+		}
+	}
+}